@@ -0,0 +1,61 @@
+package prefixed_test
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/mgutz/ansi"
+	"github.com/sirupsen/logrus"
+	prefixed "github.com/umayr/logrus-prefixed-formatter"
+)
+
+type nopHook struct{}
+
+func (nopHook) Levels() []logrus.Level   { return logrus.AllLevels }
+func (nopHook) Fire(*logrus.Entry) error { return nil }
+
+func logFromHelper(logger *logrus.Logger) {
+	logger.WithField("animal", "walrus").Info("hello")
+}
+
+func TestReportCaller(t *testing.T) {
+	for _, hooked := range []bool{false, true} {
+		var b bytes.Buffer
+		logger := logrus.New()
+		logger.Out = &b
+		logger.Formatter = &prefixed.TextFormatter{DisableColors: true, DisableTimestamp: true, ReportCaller: true}
+		if hooked {
+			logger.Hooks.Add(nopHook{})
+		}
+
+		logFromHelper(logger)
+		if !regexp.MustCompile(` caller="caller_test\.go:\d+" `).MatchString(b.String()) {
+			t.Errorf("hooked %v: caller_test.go not reported as the caller in %q", hooked, b.String())
+		}
+	}
+
+	var b bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &b
+	logger.Formatter = &prefixed.TextFormatter{ForceColors: true, DisableTimestamp: true, ReportCaller: true, Colors: &prefixed.Colors{Caller: "green"}}
+	logFromHelper(logger)
+	want := regexp.MustCompile("hello " + regexp.QuoteMeta(ansi.Green) + `caller_test\.go:\d+` + regexp.QuoteMeta(ansi.Reset))
+	if !want.MatchString(b.String()) {
+		t.Errorf("colored caller missing from %q", b.String())
+	}
+}
+
+func TestCallerHyperlink(t *testing.T) {
+	link := regexp.MustCompile(regexp.QuoteMeta("\x1b]8;;file://") + `/\S*/caller_test\.go` + regexp.QuoteMeta("\x1b\\") + `caller_test\.go:\d+` + regexp.QuoteMeta("\x1b]8;;\x1b\\"))
+	for _, colored := range []bool{false, true} {
+		var b bytes.Buffer
+		logger := logrus.New()
+		logger.Out = &b
+		logger.Formatter = &prefixed.TextFormatter{ForceColors: colored, DisableColors: !colored, DisableTimestamp: true, ReportCaller: true, CallerHyperlink: true}
+		logFromHelper(logger)
+		if got := link.MatchString(b.String()); got != colored {
+			t.Errorf("colored %v: hyperlink %v in %q", colored, got, b.String())
+		}
+	}
+}
@@ -2,40 +2,134 @@ package prefixed
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/mgutz/ansi"
+	"github.com/sirupsen/logrus"
 )
 
-const reset = ansi.Reset
+const (
+	fieldsEllipsis = " …"
+	legendMessage  = "The quick brown fox jumps over the lazy dog"
+)
+
+// States of the cached TTY detection.
+const (
+	terminalUnknown int32 = iota
+	terminalNo
+	terminalYes
+)
 
 var (
-	baseTimestamp time.Time
-	isTerminal    bool
+	noColor    bool
+	forceColor bool
+
+	logrusPackage    = reflect.TypeOf(logrus.Entry{}).PkgPath()
+	formatterPackage = reflect.TypeOf(TextFormatter{}).PkgPath()
+
+	fieldColorPalette = []string{
+		ansi.Cyan, ansi.Green, ansi.Magenta, ansi.Yellow, ansi.Blue,
+		ansi.LightCyan, ansi.LightGreen, ansi.LightMagenta, ansi.LightYellow, ansi.LightBlue,
+	}
+
+	ansiRegex          = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]|\x1b\\][^\x07\x1b]*(?:\x07|\x1b\\\\)")
+	defaultPrefixRegex = regexp.MustCompile("^\\[(.*?)\\]")
+	prefixRegexes      = map[[2]string]*regexp.Regexp{}
+	prefixRegexesMu    sync.RWMutex
+
+	controlCharReplacer = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+	fieldsPool = sync.Pool{
+		New: func() interface{} {
+			fields := make([]field, 0, 16)
+			return &fields
+		},
+	}
+
+	// The hostname is looked up once, through osHostname so that it can be
+	// stubbed out.
+	osHostname   = os.Hostname
+	hostname     string
+	hostnameOnce sync.Once
 )
 
 func init() {
-	baseTimestamp = time.Now()
-	isTerminal = logrus.IsTerminal()
+	loadColorEnv()
 }
 
-func miniTS() int {
-	return int(time.Since(baseTimestamp) / time.Second)
+// loadColorEnv caches the environment variables consulted by IsColored.
+func loadColorEnv() {
+	noColor = os.Getenv("NO_COLOR") != ""
+	forceColor = isEnvEnabled("CLICOLOR_FORCE") || isEnvEnabled("FORCE_COLOR")
+}
+
+// FieldFormat selects how the fields of an entry are rendered.
+type FieldFormat int
+
+const (
+	// FieldFormatLogfmt renders the fields as space separated key=value pairs.
+	FieldFormatLogfmt FieldFormat = iota
+	// FieldFormatJSON renders the fields as a single compact JSON object.
+	FieldFormatJSON
+)
+
+// LevelTextCase selects the letter case of the level text.
+type LevelTextCase int
+
+const (
+	// LevelTextUpper prints the level text in upper case, e.g. "WARN".
+	LevelTextUpper LevelTextCase = iota
+	// LevelTextLower prints the level text in lower case, e.g. "warn".
+	LevelTextLower
+	// LevelTextTitle capitalizes the level text, e.g. "Warn".
+	LevelTextTitle
+	// LevelTextAsIs prints the name logrus gives the level, e.g. "warning".
+	LevelTextAsIs
+)
+
+// field is a single key/value pair of an entry as it gets printed.
+type field struct {
+	key   string
+	value interface{}
 }
 
 type Colors struct {
-	Debug   string
-	Info    string
-	Warn    string
-	Error   string
-	Prefix  string
-	Default string
+	Trace      string
+	Debug      string
+	Info       string
+	Warn       string
+	Error      string
+	Fatal      string
+	Panic      string
+	Prefix     string
+	Default    string
+	FieldValue string
+	Caller     string
+	Timestamp  string
+	Equals     string
+	Unknown    string
 }
 
 type TextFormatter struct {
@@ -45,21 +139,325 @@ type TextFormatter struct {
 	// Force disabling colors.
 	DisableColors bool
 
+	// Color the output on Windows consoles as well, by switching them to virtual
+	// terminal mode. Colors stay off if the console doesn't support it.
+	EnableWindowsColors bool
+
+	// Writer the logger sends the output to, e.g. logger.Out. When set, colors
+	// are only used by default if it's a terminal, instead of checking stderr.
+	// Call ResetTerminal after changing it on a formatter already in use.
+	Output io.Writer
+
 	// Disable timestamp logging. useful when output is redirected to logging
 	// system that already adds timestamps.
 	DisableTimestamp bool
 
-	// Enable logging of just the time passed since beginning of execution.
+	// Levels to print the timestamp for, e.g. only logrus.WarnLevel and above.
+	// Takes precedence over DisableTimestamp when set.
+	TimestampLevels []logrus.Level
+
+	// Enable logging of just the time passed since the formatter was first used.
 	ShortTimestamp bool
 
+	// Unit of the time passed printed with ShortTimestamp, e.g. time.Millisecond
+	// for high-frequency logs. Defaults to seconds.
+	ShortTimestampUnit time.Duration
+
+	// Number of digits the short timestamp is zero-padded to, 4 by default. Set
+	// to -1 to disable padding altogether.
+	ShortTimestampPadding int
+
+	// Print the short timestamp right after the full one in the colored output,
+	// like [12:00:00][+0042], regardless of ShortTimestamp.
+	ShowBothTimestamps bool
+
+	// Strings surrounding the timestamp in the colored output, e.g. "(" and ")".
+	// When both are empty the default square brackets are used.
+	TimestampPrefix string
+	TimestampSuffix string
+
+	// Leave the timestamp of the colored output bare, without TimestampPrefix
+	// and TimestampSuffix.
+	DisableTimestampDelimiters bool
+
 	// Timestamp format to use for display when a full timestamp is printed.
+	// Any layout accepted by time.Format works, e.g. time.RFC3339Nano.
 	TimestampFormat string
 
+	// Add milliseconds to the default timestamp format, which then becomes
+	// time.StampMilli.
+	TimestampMillis bool
+
+	// Pad timestamps with spaces to the widest the timestamp format can produce,
+	// for layouts like "January 2" that don't have a fixed width.
+	PadTimestamp bool
+
+	// Print timestamps in UTC rather than local time.
+	UseUTC bool
+
+	// Precision time.Duration field values are rounded to, e.g. time.Millisecond.
+	// They're printed as they are by default.
+	DurationRounding time.Duration
+
+	// String put at the start of every line, e.g. an indent for logs embedded
+	// in the output of another tool. It's never colored, and counts against
+	// MaxLineWidth like the rest of the line.
+	LinePrefix string
+
+	// Leave out the newline terminating every entry, e.g. when the output ends up
+	// in a system that separates entries by itself.
+	DisableNewline bool
+
 	// The fields are sorted by default for a consistent output. For applications
 	// that log extremely frequently and don't use the JSON formatter this may not
 	// be desired.
 	DisableSorting bool
 
+	// Keep the output deterministic even with DisableSorting. Entries store their
+	// fields in a map, which doesn't remember the order they were added in, so
+	// the fields end up sorted after all.
+	StableUnsortedOrder bool
+
+	// Format of the fields, either FieldFormatLogfmt, the default, or
+	// FieldFormatJSON to render them as a single JSON object.
+	FieldFormat FieldFormat
+
+	// Render the whole entry as a single JSON object when FieldFormat is
+	// FieldFormatJSON, instead of just the fields. The colored output is never
+	// used then. Fields clashing with the keys of the entry are renamed, e.g.
+	// to "fields.prefix".
+	FullJSONFallback bool
+
+	// Add the process ID and the hostname of the machine as the pid and host
+	// fields, unless the entry already has fields of that name.
+	ShowPID      bool
+	ShowHostname bool
+
+	// Keys of the only fields to print, in the order to print them in. Takes
+	// precedence over HiddenFields and the sorting options when set.
+	OnlyFields []string
+
+	// Levels at which particular fields are printed, e.g. only logrus.DebugLevel
+	// for verbose ones. Fields missing from the map are printed at every level.
+	FieldLevels map[string][]logrus.Level
+
+	// Keys of fields that are never printed, e.g. noisy ones that can't be
+	// removed where they're logged.
+	HiddenFields []string
+
+	// Keys of fields to print first, in the given order, followed by the rest
+	// sorted alphabetically. Ignored when SortFunc is set.
+	PriorityKeys []string
+
+	// Custom ordering for the field keys, used in place of the default
+	// alphabetical sort. The slice never contains the prefix field.
+	SortFunc func(keys []string)
+
+	// Hook to replace field values before they're printed, e.g. to redact
+	// passwords. It's called with the key the field was logged with, and only
+	// for actual fields, not for the prefix, time, msg or level.
+	ValueFormatter func(key string, value interface{}) interface{}
+
+	// Report the file and line of the code that issued the log call.
+	ReportCaller bool
+
+	// Make the reported caller a hyperlink to its file in the colored output,
+	// for terminals that support OSC 8 hyperlinks.
+	CallerHyperlink bool
+
+	// Render error values with %+v instead of Error(), which includes stack
+	// traces of errors that support it, like those of pkg/errors. Multi-line
+	// output is quoted, or escaped in the colored output unless
+	// DisableControlCharEscaping is set.
+	ExpandErrors bool
+
+	// Separator put between fields, a single space by default.
+	FieldSeparator string
+
+	// Separator put between the key and the value of a field, "=" by default.
+	// Anything else breaks logfmt parsers, Parse included.
+	KeyValueSeparator string
+
+	// Wrap empty string values in quotes so that they can be told apart from
+	// missing ones.
+	QuoteEmptyFields bool
+
+	// Always quote string values, even those that don't need it.
+	ForceQuote bool
+
+	// Keys of fields whose string and error values are always quoted, like
+	// ForceQuote does for all of them.
+	AlwaysQuoteFields []string
+
+	// Render byte slice values as hex. By default only those that aren't valid
+	// UTF-8 are, and the others are rendered like string values, which are
+	// only quoted when they need it.
+	BytesAsHex bool
+
+	// Strip ANSI escape sequences from string values, so that pre-colored
+	// values can't mess with the colors of the fields that follow them.
+	StripFieldANSI bool
+
+	// Render map, slice and struct values as indented JSON on lines of their
+	// own beneath the entry, instead of inline.
+	PrettyFields bool
+
+	// Leave newlines, carriage returns and tabs in field values as they are.
+	// By default they're escaped, so that a single entry never spans several
+	// lines. Quoted values are always escaped.
+	DisableControlCharEscaping bool
+
+	// Width of the column the level text is right-aligned to in the colored
+	// output, 5 by default, which fits the standard level names, and 1 with
+	// LevelLetter. Set to -1 to disable padding altogether.
+	LevelPadding int
+
+	// Cut level text longer than LevelPadding off, e.g. long LevelNames, instead
+	// of letting it widen the column. Off by default.
+	TruncateLevelText bool
+
+	// Left-align the level text within LevelPadding instead of right-aligning
+	// it.
+	LevelLeftAlign bool
+
+	// Levels to ring the terminal bell for, e.g. logrus.ErrorLevel and above.
+	// Only rings when the output is colored and a terminal.
+	BellOnLevels []logrus.Level
+
+	// Lines printed before the entries of particular levels, e.g. a row of
+	// dashes before every error to make it stand out.
+	SeparatorBeforeLevel map[logrus.Level]string
+
+	// Highlight the level text with its color as the background in the colored
+	// output, instead of coloring the text itself.
+	LevelBackground bool
+
+	// Print the level text before the timestamp in the colored output.
+	LevelFirst bool
+
+	// Custom labels for the levels, e.g. "WRN" for logrus.WarnLevel. Levels
+	// missing from the map are rendered as usual.
+	LevelNames map[logrus.Level]string
+
+	// Shorten the level text of the colored output to its first letter, e.g. "W"
+	// for warnings. Custom LevelNames are left as they are. LevelPadding
+	// defaults to 1 with it.
+	LevelLetter bool
+
+	// Letter case of the level text in the colored output, LevelTextUpper by
+	// default. Custom LevelNames are left as they are.
+	LevelTextCase LevelTextCase
+
+	// Leave out the level text. The colored output then shows the level through
+	// the color of the message alone.
+	DisableLevelText bool
+
+	// Print just the prefix, the message and the fields, as if both
+	// DisableTimestamp and DisableLevelText were set.
+	MinimalMode bool
+
+	// Icons printed in front of the level text of the colored output, e.g. "⚠️"
+	// for warnings. Keep in mind that terminals disagree on how wide emoji are,
+	// so they may throw off the alignment of the lines.
+	LevelIcons map[logrus.Level]string
+
+	// Print the message in the color of its level, too.
+	ColorMessage bool
+
+	// Name of a field whose value determines the color used in place of the level
+	// color, e.g. "tenant". Every value gets its own color, which stays the same
+	// across lines. Entries without the field are colored by their level.
+	ColorByField string
+
+	// Field whose value, a color style like those of Colors, overrides the
+	// color of its entry, "_color" by default. Invalid styles are ignored. The
+	// field itself is never printed.
+	ColorFieldName string
+
+	// Maximum width of a colored line. Fields that don't fit are cut off and
+	// replaced with an ellipsis, the message itself is always kept whole. Set to
+	// -1 to use the width of the terminal Output, or stderr, is attached to.
+	MaxLineWidth int
+
+	// Maximum number of fields in the colored output. The rest are summed up by
+	// a "(+N more)" marker. Zero shows all of them.
+	MaxFields int
+
+	// Print the fields on a line of their own beneath the message in the
+	// colored output, indented by FieldIndent, two spaces by default.
+	FieldsOnNewLine bool
+	FieldIndent     string
+
+	// Push the fields to the right edge of the colored line, which is
+	// MaxLineWidth wide when set and as wide as the terminal Output, or stderr,
+	// is attached to otherwise. Lines that are already too long are left alone.
+	RightAlignFields bool
+
+	// Maximum number of characters of a message. Longer ones are cut off and
+	// marked with MessageEllipsis, "…" by default. Zero keeps messages whole.
+	MaxMessageLength int
+	MessageEllipsis  string
+
+	// Wrap long messages in the colored output on spaces, at MaxLineWidth when
+	// set and at the width of the terminal Output, or stderr, is attached to
+	// otherwise. Continuation lines are indented to line up with the start of
+	// the message, fields follow the last one.
+	WrapMessage bool
+
+	// Minimum width of the message in the colored output. Shorter messages are
+	// padded with spaces, so that the fields following them line up. Messages
+	// aren't padded with FieldsOnNewLine, which leaves nothing to line up.
+	PadMessageTo int
+
+	// Field the prefix is taken from, "prefix" by default.
+	PrefixFieldName string
+
+	// Prefixes whose entries aren't printed at all, e.g. to silence a noisy
+	// component without touching the logger's level.
+	SkipPrefixes []string
+
+	// Delimiters surrounding a prefix embedded at the start of a message, e.g.
+	// "(" and ")" for messages like "(main) Started". When both are empty the
+	// default square brackets are used.
+	PrefixStart string
+	PrefixEnd   string
+
+	// String put after the prefix in the colored output, a colon by default.
+	PrefixSuffix string
+
+	// Leave the prefix of the colored output bare, without PrefixSuffix.
+	DisablePrefixSuffix bool
+
+	// Minimum width of the prefix in the colored output. Shorter prefixes are
+	// padded with spaces, so that the messages following them line up.
+	PrefixPadding int
+
+	// Drop a prefix embedded in the message even when the prefix field is set,
+	// which otherwise wins and leaves the message untouched.
+	AlwaysStripMessagePrefix bool
+
+	// Colors of particular prefixes, e.g. "cyan" for "db", in place of
+	// Colors.Prefix.
+	PrefixColors map[string]string
+
+	// Separator put between the prefix and the message, a single space by
+	// default.
+	PrefixMessageSeparator string
+
+	// Extract a run of consecutive prefixes, like "[http][auth]", instead of
+	// just the first one. They're joined with PrefixSeparator, "/" by default.
+	MergeNestedPrefixes bool
+	PrefixSeparator     string
+
+	// Merge the prefix into the level text in the colored output, rendering
+	// them as a single token like ERROR[db]. LevelPadding doesn't apply to it.
+	CompactPrefix bool
+
+	// Sequence ending every colored piece of the colored output, ansi.Reset by
+	// default. Set it for terminals or log processors that can't handle the
+	// full SGR reset.
+	ResetCode string
+
 	// Set custom 256-bit colors for the colored output.
 	// Available colors:
 	// - black
@@ -71,6 +469,7 @@ type TextFormatter struct {
 	// - cyan
 	// - white
 	// - 0...255 (256 colors)
+	// - #rrggbb or #rgb (24-bit colors)
 	//
 	// Available attributes:
 	// b = bold foreground
@@ -82,185 +481,1641 @@ type TextFormatter struct {
 	// For example,
 	// "white+u:black" - display underlined white text on black background
 	// "red+b:white" - display red with bold text on white background
+	//
+	// Colors left empty, or a nil Colors altogether, fall back to the defaults.
 	Colors *Colors
+
+	// Time the short timestamps are counted from, set on first use.
+	baseTimestamp atomic.Value
+
+	// Cached result of the TTY detection, one of the terminal* states.
+	terminal int32
 }
 
-func (f *TextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	var keys []string = make([]string, 0, len(entry.Data))
-	for k := range entry.Data {
-		if k != "prefix" {
-			keys = append(keys, k)
+var _ logrus.Formatter = (*TextFormatter)(nil)
+
+// Formatter returns a pointer to a copy of f, which is what logrus.Formatter
+// needs, so that a formatter can be configured and installed in a single
+// expression:
+//
+//	log.Formatter = prefixed.TextFormatter{ForceColors: true}.Formatter()
+func (f TextFormatter) Formatter() *TextFormatter {
+	return &f
+}
+
+// NewFormatter returns a TextFormatter with the default colors, timestamp
+// format and paddings already set up.
+func NewFormatter() *TextFormatter {
+	f := &TextFormatter{
+		TimestampFormat:       time.Stamp,
+		ShortTimestampPadding: 4,
+		LevelPadding:          5,
+		Colors:                &Colors{},
+	}
+	f.ResetTimer()
+	return f
+}
+
+// ResetTimer restarts the time passed printed with ShortTimestamp from zero.
+func (f *TextFormatter) ResetTimer() {
+	f.baseTimestamp.Store(time.Now())
+}
+
+func (f *TextFormatter) miniTS() int {
+	base, ok := f.baseTimestamp.Load().(time.Time)
+	if !ok {
+		f.baseTimestamp.CompareAndSwap(nil, time.Now())
+		base = f.baseTimestamp.Load().(time.Time)
+	}
+
+	unit := f.ShortTimestampUnit
+	if unit <= 0 {
+		unit = time.Second
+	}
+	return int(time.Since(base) / unit)
+}
+
+// Clone returns a copy of f that can be changed without affecting f, e.g. to
+// tweak a shared base configuration. Colors and the maps and slices are copied
+// as well, while Output, SortFunc and ValueFormatter are shared. The clone
+// keeps counting ShortTimestamp from the same moment but detects the terminal
+// afresh.
+func (f *TextFormatter) Clone() *TextFormatter {
+	clone := &TextFormatter{}
+	*clone = *f
+	clone.baseTimestamp = atomic.Value{}
+	if base := f.baseTimestamp.Load(); base != nil {
+		clone.baseTimestamp.Store(base)
+	}
+	clone.terminal = terminalUnknown
+
+	if f.Colors != nil {
+		colors := *f.Colors
+		clone.Colors = &colors
+	}
+	if f.TimestampLevels != nil {
+		clone.TimestampLevels = append([]logrus.Level(nil), f.TimestampLevels...)
+	}
+	clone.LevelNames = copyLevelStrings(f.LevelNames)
+	clone.LevelIcons = copyLevelStrings(f.LevelIcons)
+	clone.SeparatorBeforeLevel = copyLevelStrings(f.SeparatorBeforeLevel)
+	clone.OnlyFields = copyStrings(f.OnlyFields)
+	clone.HiddenFields = copyStrings(f.HiddenFields)
+	clone.SkipPrefixes = copyStrings(f.SkipPrefixes)
+	clone.PriorityKeys = copyStrings(f.PriorityKeys)
+	if f.FieldLevels != nil {
+		clone.FieldLevels = make(map[string][]logrus.Level, len(f.FieldLevels))
+		for k, v := range f.FieldLevels {
+			clone.FieldLevels[k] = append([]logrus.Level(nil), v...)
 		}
 	}
+	if f.BellOnLevels != nil {
+		clone.BellOnLevels = append([]logrus.Level(nil), f.BellOnLevels...)
+	}
+	clone.AlwaysQuoteFields = copyStrings(f.AlwaysQuoteFields)
+	if f.PrefixColors != nil {
+		clone.PrefixColors = make(map[string]string, len(f.PrefixColors))
+		for k, v := range f.PrefixColors {
+			clone.PrefixColors[k] = v
+		}
+	}
+	return clone
+}
 
-	if !f.DisableSorting {
-		sort.Strings(keys)
+func copyLevelStrings(m map[logrus.Level]string) map[logrus.Level]string {
+	if m == nil {
+		return nil
 	}
+	copied := make(map[logrus.Level]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
 
-	b := &bytes.Buffer{}
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
 
-	prefixFieldClashes(entry.Data)
+func (f *TextFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// A nil Data map reads like an empty one, only the entry itself can't be
+	// nil.
+	if entry == nil {
+		return nil, fmt.Errorf("cannot format a nil entry")
+	}
+	if f.skipped(entry) {
+		return []byte{}, nil
+	}
 
-	isColorTerminal := isTerminal && (runtime.GOOS != "windows")
-	isColored := (f.ForceColors || isColorTerminal) && !f.DisableColors
+	pooledFields := fieldsPool.Get().(*[]field)
+	fields := (*pooledFields)[:0]
+	defer func() {
+		// Drop the values, so that the pool doesn't keep them alive.
+		for i := range fields {
+			fields[i] = field{}
+		}
+		*pooledFields = fields[:0]
+		fieldsPool.Put(pooledFields)
+	}()
 
-	timestampFormat := f.TimestampFormat
-	if timestampFormat == "" {
-		timestampFormat = time.Stamp
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer bufferPool.Put(b)
+
+	if separator, ok := f.SeparatorBeforeLevel[entry.Level]; ok {
+		b.WriteString(separator)
+		b.WriteByte('\n')
+	}
+
+	var caller *runtime.Frame
+	if f.ReportCaller {
+		caller = getCaller()
+	}
+
+	fullJSON := f.FieldFormat == FieldFormatJSON && f.FullJSONFallback
+	colored := !fullJSON && f.IsColored()
+	if !colored {
+		fields = f.collectFields(entry, fields)
+		prefixFieldClashes(fields)
 	}
-	if isColored {
-		f.printColored(b, entry, keys, timestampFormat)
+	if fullJSON {
+		f.printJSON(b, entry, fields, caller)
+	} else if colored {
+		fields = f.printColored(b, entry, fields, caller)
 	} else {
-		if !f.DisableTimestamp {
-			f.appendKeyValue(b, "time", entry.Time.Format(timestampFormat))
+		if f.showTimestamp(entry.Level) {
+			f.appendKeyValue(b, "time", f.formatTime(entry.Time))
+		}
+		levelText := levelName(entry.Level)
+		if name, ok := f.LevelNames[entry.Level]; ok {
+			levelText = name
+		}
+		if f.showLevelText() {
+			f.appendKeyValue(b, "level", levelText)
 		}
-		f.appendKeyValue(b, "level", entry.Level.String())
 		if entry.Message != "" {
-			f.appendKeyValue(b, "msg", entry.Message)
+			f.appendKeyValue(b, "msg", f.truncateMessage(entry.Message))
 		}
-		for _, key := range keys {
-			f.appendKeyValue(b, key, entry.Data[key])
+		if caller != nil {
+			f.appendKeyValue(b, "caller", callerText(caller))
 		}
-	}
-
-	b.WriteByte('\n')
-	return b.Bytes(), nil
-}
-
-func (f *TextFormatter) printColored(b *bytes.Buffer, entry *logrus.Entry, keys []string, timestampFormat string) {
-	var levelColor string
-	var levelText string
-	switch entry.Level {
-	case logrus.DebugLevel:
-		levelColor = func() string {
-			c := ansi.White
-			if f.Colors.Debug != "" {
-				c = ansi.ColorCode(f.Colors.Debug)
+		if f.FieldFormat == FieldFormatJSON {
+			if len(fields) > 0 {
+				b.WriteString(fieldsToJSON(fields))
 			}
-			return c
-		}()
-	case logrus.InfoLevel:
-		levelColor = func() string {
-			c := ansi.Blue
-			if f.Colors.Info != "" {
-				c = ansi.ColorCode(f.Colors.Info)
-			}
-			return c
-		}()
-	case logrus.WarnLevel:
-		levelColor = func() string {
-			c := ansi.Yellow
-			if f.Colors.Warn != "" {
-				c = ansi.ColorCode(f.Colors.Warn)
+		} else {
+			var pretty []string
+			for _, field := range fields {
+				if value, ok := f.prettyValue(field.value); ok {
+					pretty = append(pretty, "\n  "+field.key+f.keyValueSeparator()+value)
+					continue
+				}
+				f.appendKeyValue(b, field.key, field.value)
 			}
-			return c
-		}()
-	case logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel:
-		levelColor = func() string {
-			c := ansi.Red
-			if f.Colors.Error != "" {
-				c = ansi.ColorCode(f.Colors.Error)
+			for _, field := range pretty {
+				b.WriteString(field)
 			}
-			return c
-		}()
-	default:
-		levelColor = func() string {
-			c := ansi.White
-			if f.Colors.Default != "" {
-				c = ansi.ColorCode(f.Colors.Default)
+		}
+	}
+
+	if !f.DisableNewline {
+		b.WriteByte('\n')
+	}
+	if f.LinePrefix != "" {
+		prefixLines(b, f.LinePrefix)
+	}
+	if colored && f.isTerminal() {
+		for _, level := range f.BellOnLevels {
+			if level == entry.Level {
+				b.WriteByte('\a')
+				break
 			}
-			return c
-		}()
+		}
 	}
+	// The buffer goes back to the pool, so the caller gets a copy.
+	return append([]byte(nil), b.Bytes()...), nil
+}
 
-	if entry.Level != logrus.WarnLevel {
-		levelText = strings.ToUpper(entry.Level.String())
-	} else {
-		levelText = "WARN"
+// prefixLines puts prefix at the start of every line in b.
+func prefixLines(b *bytes.Buffer, prefix string) {
+	text := b.String()
+	b.Reset()
+	for text != "" {
+		b.WriteString(prefix)
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i+1])
+		text = text[i+1:]
 	}
+}
 
-	prefix := ""
-	message := entry.Message
-	prefixColor := ansi.LightBlack
-	if f.Colors.Prefix != "" {
-		prefixColor = ansi.ColorCode(f.Colors.Prefix)
+// String describes the effective configuration of f, one option per line, with
+// defaults filled in for options left empty. It's meant for bug reports.
+func (f *TextFormatter) String() string {
+	resolved := map[string]interface{}{
+		"FieldSeparator":        f.fieldSeparator(),
+		"KeyValueSeparator":     f.keyValueSeparator(),
+		"PrefixFieldName":       f.prefixFieldName(),
+		"PrefixSuffix":          f.prefixSuffix(),
+		"ColorFieldName":        f.colorFieldName(),
+		"LevelPadding":          f.levelPadding(),
+		"ShortTimestampPadding": f.shortTimestampPadding(),
+	}
+	if f.TimestampFormat == "" {
+		resolved["TimestampFormat"] = time.Stamp
+	}
+	if f.ShortTimestampUnit <= 0 {
+		resolved["ShortTimestampUnit"] = time.Second
+	}
+	resolved["TimestampPrefix"], resolved["TimestampSuffix"] = f.timestampDelimiters()
+	if f.PrefixStart == "" && f.PrefixEnd == "" {
+		resolved["PrefixStart"], resolved["PrefixEnd"] = "[", "]"
+	}
+	if f.PrefixSeparator == "" {
+		resolved["PrefixSeparator"] = "/"
+	}
+	if f.PrefixMessageSeparator == "" {
+		resolved["PrefixMessageSeparator"] = " "
+	}
+	if f.FieldIndent == "" {
+		resolved["FieldIndent"] = "  "
+	}
+	if f.MessageEllipsis == "" {
+		resolved["MessageEllipsis"] = "…"
+	}
+	if f.ResetCode == "" {
+		resolved["ResetCode"] = ansi.Reset
+	}
+	if f.Colors == nil {
+		resolved["Colors"] = &Colors{}
 	}
 
-	if prefixValue, ok := entry.Data["prefix"]; ok {
-		prefix = fmt.Sprintf("%s (%s):%s", prefixColor, prefixValue, reset)
-	} else if prefixValue, trimmedMsg := extractPrefix(entry.Message); prefixValue != "" {
-		prefix, message = fmt.Sprintf("%s (%s):%s", prefixColor, prefixValue, reset), trimmedMsg
+	var b bytes.Buffer
+	b.WriteString("prefixed.TextFormatter:\n")
+	v := reflect.ValueOf(f).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if field.Kind() == reflect.Func {
+			fmt.Fprintf(&b, "  %s: set=%v\n", name, !field.IsNil())
+			continue
+		}
+		value := field.Interface()
+		if r, ok := resolved[name]; ok {
+			value = r
+		}
+		switch value := value.(type) {
+		case io.Writer:
+			fmt.Fprintf(&b, "  %s: %T\n", name, value)
+		case string:
+			fmt.Fprintf(&b, "  %s: %q\n", name, value)
+		case *Colors:
+			fmt.Fprintf(&b, "  %s: %+v\n", name, *value)
+		default:
+			fmt.Fprintf(&b, "  %s: %v\n", name, value)
+		}
 	}
+	fmt.Fprintf(&b, "  colored: %v\n", f.IsColored())
+	return b.String()
+}
+
+// FormatString works like Format but returns the entry as a string.
+func (f *TextFormatter) FormatString(entry *logrus.Entry) (string, error) {
+	serialized, err := f.Format(entry)
+	return string(serialized), err
+}
 
-	if f.ShortTimestamp {
-		fmt.Fprintf(b, "%s[%04d]%s %s%+5s%s%s %s", prefixColor, miniTS(), reset, levelColor, levelText, reset, prefix, message)
+// skipped reports whether the prefix of entry, explicit or extracted from the
+// message, is one of SkipPrefixes.
+func (f *TextFormatter) skipped(entry *logrus.Entry) bool {
+	if len(f.SkipPrefixes) == 0 {
+		return false
+	}
+	prefix := ""
+	if value, ok := entry.Data[f.prefixFieldName()]; ok {
+		prefix = fmt.Sprint(value)
 	} else {
-		fmt.Fprintf(b, "%s[%s]%s %s%+5s%s%s %s", prefixColor, entry.Time.Format(timestampFormat), reset, levelColor, levelText, reset, prefix, message)
+		prefix, _ = f.extractPrefix(entry.Message)
 	}
-	for _, k := range keys {
-		v := entry.Data[k]
-		fmt.Fprintf(b, " %s%s%s=%+v", levelColor, k, reset, v)
+	for _, skip := range f.SkipPrefixes {
+		if prefix != "" && prefix == skip {
+			return true
+		}
 	}
+	return false
 }
 
-func needsQuoting(text string) bool {
-	for _, ch := range text {
-		if !((ch >= 'a' && ch <= 'z') ||
-			(ch >= 'A' && ch <= 'Z') ||
-			(ch >= '0' && ch <= '9') ||
-			ch == '-' || ch == '.') {
-			return false
+// collectFields appends the fields of entry to print to fields, in the order to
+// print them in.
+func (f *TextFormatter) collectFields(entry *logrus.Entry, fields []field) []field {
+	if len(f.OnlyFields) > 0 {
+		for _, k := range f.OnlyFields {
+			v, ok := entry.Data[k]
+			if !ok {
+				v, ok = f.processField(k)
+			}
+			if ok && k != f.prefixFieldName() && k != f.colorFieldName() && f.fieldShown(k, entry.Level) {
+				fields = append(fields, f.newField(k, v))
+			}
 		}
+		return fields
 	}
-	return true
+
+	var hidden map[string]bool
+	if len(f.HiddenFields) > 0 {
+		hidden = make(map[string]bool, len(f.HiddenFields))
+		for _, k := range f.HiddenFields {
+			hidden[k] = true
+		}
+	}
+
+	for k, v := range entry.Data {
+		if k == f.prefixFieldName() || k == f.colorFieldName() || hidden[k] || !f.fieldShown(k, entry.Level) {
+			continue
+		}
+		fields = append(fields, f.newField(k, v))
+	}
+	for _, k := range []string{"pid", "host"} {
+		if _, ok := entry.Data[k]; ok || hidden[k] || !f.fieldShown(k, entry.Level) {
+			continue
+		}
+		if v, ok := f.processField(k); ok {
+			fields = append(fields, f.newField(k, v))
+		}
+	}
+	f.sortFields(fields)
+	return fields
 }
 
-func extractPrefix(msg string) (string, string) {
-	prefix := ""
-	regex := regexp.MustCompile("^\\[(.*?)\\]")
-	if regex.MatchString(msg) {
-		match := regex.FindString(msg)
-		prefix, msg = match[1:len(match)-1], strings.TrimSpace(msg[len(match):])
+// fieldShown reports whether the field key is shown at level according to
+// FieldLevels.
+func (f *TextFormatter) fieldShown(key string, level logrus.Level) bool {
+	levels, ok := f.FieldLevels[key]
+	if !ok {
+		return true
+	}
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
 	}
-	return prefix, msg
+	return false
 }
 
-func (f *TextFormatter) appendKeyValue(b *bytes.Buffer, key string, value interface{}) {
-	b.WriteString(key)
-	b.WriteByte('=')
+// processField returns the value of the pid or host field added by ShowPID and
+// ShowHostname, if enabled.
+func (f *TextFormatter) processField(key string) (interface{}, bool) {
+	switch {
+	case key == "pid" && f.ShowPID:
+		return os.Getpid(), true
+	case key == "host" && f.ShowHostname:
+		hostnameOnce.Do(func() {
+			hostname, _ = osHostname()
+		})
+		return hostname, hostname != ""
+	}
+	return nil, false
+}
 
-	switch value := value.(type) {
-	case string:
-		if needsQuoting(value) {
-			b.WriteString(value)
+func (f *TextFormatter) newField(k string, v interface{}) field {
+	if f.ValueFormatter != nil {
+		v = f.ValueFormatter(k, v)
+	}
+	if data, ok := v.([]byte); ok {
+		// Byte slices would otherwise show up as lists of numbers.
+		if f.BytesAsHex || !utf8.Valid(data) {
+			v = hex.EncodeToString(data)
 		} else {
-			fmt.Fprintf(b, "%q", value)
+			v = string(data)
 		}
-	case error:
-		errmsg := value.Error()
-		if needsQuoting(errmsg) {
-			b.WriteString(errmsg)
-		} else {
-			fmt.Fprintf(b, "%q", value)
+	}
+	return field{k, f.formatTimeValue(v)}
+}
+
+// formatTimeValue renders time.Time field values like timestamps and rounds
+// time.Duration ones. Other values are returned as they are.
+func (f *TextFormatter) formatTimeValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case time.Time:
+		return f.formatTime(value)
+	case time.Duration:
+		if f.DurationRounding > 0 {
+			value = value.Round(f.DurationRounding)
 		}
-	default:
-		fmt.Fprint(b, value)
+		return value.String()
 	}
+	return value
+}
 
-	b.WriteByte(' ')
+func (f *TextFormatter) showLevelText() bool {
+	return !f.DisableLevelText && !f.MinimalMode
 }
 
-func prefixFieldClashes(data logrus.Fields) {
-	_, ok := data["time"]
-	if ok {
-		data["fields.time"] = data["time"]
+func (f *TextFormatter) showTimestamp(level logrus.Level) bool {
+	if f.MinimalMode {
+		return false
 	}
-	_, ok = data["msg"]
-	if ok {
-		data["fields.msg"] = data["msg"]
+	if f.TimestampLevels == nil {
+		return !f.DisableTimestamp
 	}
-	_, ok = data["level"]
-	if ok {
-		data["fields.level"] = data["level"]
+	for _, l := range f.TimestampLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// timestampLayout returns the layout timestamps are formatted with.
+func (f *TextFormatter) timestampLayout() string {
+	timestampFormat := f.TimestampFormat
+	if timestampFormat == "" {
+		timestampFormat = time.Stamp
+	}
+	if f.TimestampMillis && timestampFormat == time.Stamp {
+		timestampFormat = time.StampMilli
+	}
+	return timestampFormat
+}
+
+// formatTime renders t the way the timestamps of entries are printed.
+func (f *TextFormatter) formatTime(t time.Time) string {
+	timestampFormat := f.timestampLayout()
+	if f.UseUTC {
+		t = t.UTC()
+	}
+
+	timestamp := t.Format(timestampFormat)
+	if f.PadTimestamp {
+		if padding := timestampWidth(timestampFormat, t.Location()) - utf8.RuneCountInString(timestamp); padding > 0 {
+			timestamp += strings.Repeat(" ", padding)
+		}
+	}
+	return timestamp
+}
+
+// timestampWidth returns the widest a timestamp in the given layout can get.
+// Both reference times fall on a Wednesday, the longest weekday name, with
+// two-digit days and hours; September has the longest month name and December
+// is a two-digit month.
+func timestampWidth(layout string, loc *time.Location) int {
+	september := time.Date(2000, time.September, 27, 22, 59, 59, 999999999, loc)
+	december := time.Date(2000, time.December, 27, 22, 59, 59, 999999999, loc)
+	width := utf8.RuneCountInString(september.Format(layout))
+	if w := utf8.RuneCountInString(december.Format(layout)); w > width {
+		width = w
+	}
+	return width
+}
+
+// sortFields puts the fields in the order they get printed in.
+func (f *TextFormatter) sortFields(fields []field) {
+	if f.SortFunc == nil && len(f.PriorityKeys) > 0 {
+		priority := make(map[string]int, len(f.PriorityKeys))
+		for i, key := range f.PriorityKeys {
+			if _, ok := priority[key]; !ok {
+				priority[key] = i
+			}
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			pi, iok := priority[fields[i].key]
+			pj, jok := priority[fields[j].key]
+			switch {
+			case iok && jok:
+				return pi < pj
+			case iok != jok:
+				return iok
+			}
+			return fields[i].key < fields[j].key
+		})
+		return
+	}
+	if f.SortFunc == nil {
+		if !f.DisableSorting || f.StableUnsortedOrder {
+			sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+		}
+		return
+	}
+
+	keys := make([]string, len(fields))
+	values := make(map[string]interface{}, len(fields))
+	for i, field := range fields {
+		keys[i] = field.key
+		values[field.key] = field.value
+	}
+	f.SortFunc(keys)
+	for i, key := range keys {
+		fields[i] = field{key, values[key]}
+	}
+}
+
+// levelText returns the label of level in the colored output, honoring
+// LevelLetter and LevelTextCase.
+func (f *TextFormatter) levelText(level logrus.Level) string {
+	text := levelName(level)
+	if level == logrus.WarnLevel && f.LevelTextCase != LevelTextAsIs {
+		text = "warn"
+	}
+	if f.LevelLetter {
+		text = text[:1]
+	}
+
+	switch f.LevelTextCase {
+	case LevelTextLower, LevelTextAsIs:
+		return text
+	case LevelTextTitle:
+		return strings.ToUpper(text[:1]) + text[1:]
+	}
+	return strings.ToUpper(text)
+}
+
+// levelName returns the name of level, or its number for levels logrus doesn't
+// know, instead of the blanket "unknown".
+func levelName(level logrus.Level) string {
+	for _, known := range logrus.AllLevels {
+		if level == known {
+			return level.String()
+		}
+	}
+	return strconv.FormatUint(uint64(level), 10)
+}
+
+// IsColored reports whether entries get the colored output. DisableColors
+// wins over everything else, then a non-empty NO_COLOR environment variable
+// (see https://no-color.org), then either ForceColors or the CLICOLOR_FORCE and
+// FORCE_COLOR environment variables and finally TTY detection of Output or
+// stderr, which on Windows also requires EnableWindowsColors.
+func (f *TextFormatter) IsColored() bool {
+	if f.DisableColors || noColor {
+		return false
+	}
+	if f.ForceColors || forceColor {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		return f.isTerminal() && f.EnableWindowsColors && enableVirtualTerminal()
+	}
+	return f.isTerminal()
+}
+
+// isTerminal reports whether Output, or stderr if it isn't set, is a terminal.
+// The result is cached until ResetTerminal is called.
+func (f *TextFormatter) isTerminal() bool {
+	switch atomic.LoadInt32(&f.terminal) {
+	case terminalYes:
+		return true
+	case terminalNo:
+		return false
+	}
+
+	output := f.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	terminal := isTerminalWriter(output)
+	if terminal {
+		atomic.StoreInt32(&f.terminal, terminalYes)
+	} else {
+		atomic.StoreInt32(&f.terminal, terminalNo)
+	}
+	return terminal
+}
+
+// ResetTerminal makes the formatter check again whether its output is a
+// terminal, e.g. after Output was changed or stderr was redirected.
+func (f *TextFormatter) ResetTerminal() {
+	atomic.StoreInt32(&f.terminal, terminalUnknown)
+}
+
+// terminalWidth returns the width of the terminal Output, or stderr if it isn't
+// set, is attached to, or zero when it isn't a terminal.
+func (f *TextFormatter) terminalWidth() int {
+	output := f.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	if file, ok := output.(*os.File); ok {
+		return terminalWidthFd(file.Fd())
+	}
+	return 0
+}
+
+func isTerminalWriter(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	return ok && isTerminalFd(file.Fd())
+}
+
+// isEnvEnabled reports whether the environment variable is set to anything
+// but an empty string, "0" or "false".
+func isEnvEnabled(name string) bool {
+	switch os.Getenv(name) {
+	case "", "0", "false":
+		return false
+	}
+	return true
+}
+
+// renderParts returns the text of the pieces the colored output of entry is made
+// of, before any colors, padding or delimiters are applied. Pieces that aren't
+// shown are empty. The fields to print are appended to dst, in order.
+func (f *TextFormatter) renderParts(entry *logrus.Entry, dst []field) (timestamp, level, prefix, message string, fields []field) {
+	if f.showTimestamp(entry.Level) {
+		if f.ShortTimestamp && !f.ShowBothTimestamps {
+			timestamp = fmt.Sprintf("%0*d", f.shortTimestampPadding(), f.miniTS())
+		} else {
+			timestamp = f.formatTime(entry.Time)
+		}
+	}
+
+	if f.showLevelText() {
+		if name, ok := f.LevelNames[entry.Level]; ok {
+			level = name
+		} else {
+			level = f.levelText(entry.Level)
+		}
+		if padding := f.levelPadding(); f.TruncateLevelText && padding > 0 && utf8.RuneCountInString(level) > padding {
+			level = string([]rune(level)[:padding])
+		}
+	}
+
+	message = entry.Message
+	if value, ok := entry.Data[f.prefixFieldName()]; ok {
+		prefix = fmt.Sprint(value)
+		if f.AlwaysStripMessagePrefix {
+			_, message = f.extractPrefix(entry.Message)
+		}
+	} else if extracted, trimmedMsg := f.extractPrefix(entry.Message); extracted != "" {
+		prefix, message = extracted, trimmedMsg
+	}
+	return timestamp, level, prefix, f.truncateMessage(message), f.collectFields(entry, dst)
+}
+
+// truncateMessage cuts message off after MaxMessageLength runes and marks the
+// cut with MessageEllipsis.
+func (f *TextFormatter) truncateMessage(message string) string {
+	if f.MaxMessageLength <= 0 || utf8.RuneCountInString(message) <= f.MaxMessageLength {
+		return message
+	}
+	ellipsis := f.MessageEllipsis
+	if ellipsis == "" {
+		ellipsis = "…"
+	}
+	return string([]rune(message)[:f.MaxMessageLength]) + ellipsis
+}
+
+// printColored writes the colored output of entry to b. It returns the fields it
+// printed, appended to dst.
+func (f *TextFormatter) printColored(b *bytes.Buffer, entry *logrus.Entry, dst []field, caller *runtime.Frame) []field {
+	lineStart := b.Len()
+	reset := f.ResetCode
+	if reset == "" {
+		reset = ansi.Reset
+	}
+	colors := f.Colors
+	if colors == nil {
+		colors = &Colors{}
+	}
+
+	timestamp, levelText, prefixValue, message, fields := f.renderParts(entry, dst)
+
+	var levelColor string
+	switch entry.Level {
+	case logrus.TraceLevel:
+		levelColor = func() string {
+			c := ansi.LightBlack
+			if colors.Trace != "" {
+				c = colorCode(colors.Trace)
+			}
+			return c
+		}()
+	case logrus.DebugLevel:
+		levelColor = func() string {
+			c := ansi.White
+			if colors.Debug != "" {
+				c = colorCode(colors.Debug)
+			}
+			return c
+		}()
+	case logrus.InfoLevel:
+		levelColor = func() string {
+			c := ansi.Blue
+			if colors.Info != "" {
+				c = colorCode(colors.Info)
+			}
+			return c
+		}()
+	case logrus.WarnLevel:
+		levelColor = func() string {
+			c := ansi.Yellow
+			if colors.Warn != "" {
+				c = colorCode(colors.Warn)
+			}
+			return c
+		}()
+	case logrus.ErrorLevel:
+		levelColor = func() string {
+			c := ansi.Red
+			if colors.Error != "" {
+				c = colorCode(colors.Error)
+			}
+			return c
+		}()
+	case logrus.FatalLevel:
+		levelColor = func() string {
+			c := ansi.Red
+			if colors.Fatal != "" {
+				c = colorCode(colors.Fatal)
+			} else if colors.Error != "" {
+				c = colorCode(colors.Error)
+			}
+			return c
+		}()
+	case logrus.PanicLevel:
+		levelColor = func() string {
+			c := ansi.Red
+			if colors.Panic != "" {
+				c = colorCode(colors.Panic)
+			} else if colors.Error != "" {
+				c = colorCode(colors.Error)
+			}
+			return c
+		}()
+	default:
+		levelColor = func() string {
+			c := ansi.White
+			if colors.Unknown != "" {
+				c = colorCode(colors.Unknown)
+			} else if colors.Default != "" {
+				c = colorCode(colors.Default)
+			}
+			return c
+		}()
+	}
+
+	if f.ColorByField != "" {
+		if value, ok := entry.Data[f.ColorByField]; ok {
+			levelColor = colorForValue(fmt.Sprint(value))
+		}
+	}
+	if value, ok := entry.Data[f.colorFieldName()]; ok {
+		if spec := fmt.Sprint(value); isColorSpec(spec) {
+			levelColor = colorCode(spec)
+		}
+	}
+
+	prefix := ""
+	prefixColor := ansi.LightBlack
+	if colors.Prefix != "" {
+		prefixColor = colorCode(colors.Prefix)
+	}
+
+	compact := f.CompactPrefix && f.showLevelText()
+	if prefixValue != "" && !compact {
+		prefixText := fmt.Sprintf("(%s)%s", prefixValue, f.prefixSuffix())
+		if padding := f.PrefixPadding - displayWidth(prefixText); padding > 0 {
+			prefixText += strings.Repeat(" ", padding)
+		}
+		color := prefixColor
+		if spec, ok := f.PrefixColors[prefixValue]; ok && spec != "" {
+			color = colorCode(spec)
+		}
+		prefix = color + prefixText + reset
+	}
+
+	timestampColor := prefixColor
+	if colors.Timestamp != "" {
+		timestampColor = colorCode(colors.Timestamp)
+	}
+	timestampPart := ""
+	if timestamp != "" {
+		start, end := f.timestampDelimiters()
+		timestampPart = fmt.Sprintf("%s%s%s%s%s", timestampColor, start, timestamp, end, reset)
+		if f.ShowBothTimestamps {
+			timestampPart += fmt.Sprintf("%s%s+%0*d%s%s", timestampColor, start, f.shortTimestampPadding(), f.miniTS(), end, reset)
+		}
+	}
+
+	parts := make([]string, 0, 4)
+	if timestampPart != "" && !f.LevelFirst {
+		parts = append(parts, timestampPart)
+	}
+	if icon, ok := f.LevelIcons[entry.Level]; ok {
+		parts = append(parts, icon)
+	}
+	levelStyle := levelColor
+	if f.LevelBackground {
+		// Inverse video swaps the level color into the background.
+		levelStyle += "\x1b[7m"
+	}
+	if compact {
+		token := levelText
+		if prefixValue != "" {
+			token += fmt.Sprintf("[%s]", prefixValue)
+		}
+		parts = append(parts, levelStyle+token+reset)
+	} else if f.showLevelText() {
+		if padding := f.levelPadding() - displayWidth(levelText); padding > 0 {
+			if f.LevelLeftAlign {
+				levelText += strings.Repeat(" ", padding)
+			} else {
+				levelText = strings.Repeat(" ", padding) + levelText
+			}
+		}
+		parts = append(parts, levelStyle+levelText+reset)
+	}
+	if timestampPart != "" && f.LevelFirst {
+		parts = append(parts, timestampPart)
+	}
+	messageSeparator := f.PrefixMessageSeparator
+	if messageSeparator == "" {
+		messageSeparator = " "
+	}
+	// LinePrefix is added once the entry is done, but takes up room too.
+	linePrefixWidth := displayWidth(f.LinePrefix)
+	lines := []string{message}
+	indent := ""
+	if f.WrapMessage && message != "" {
+		width := f.MaxLineWidth
+		if width <= 0 {
+			width = f.terminalWidth()
+		}
+		width -= linePrefixWidth
+		head := strings.Join(parts, " ")
+		if head != "" {
+			head += " "
+		}
+		if prefix != "" {
+			head += prefix + messageSeparator
+		}
+		if column := displayWidth(head); width-column > 0 {
+			lines = wrapWords(message, width-column)
+			indent = strings.Repeat(" ", column)
+		}
+	}
+	for i := range lines {
+		// Without the level text the message carries the level color instead.
+		if lines[i] != "" && (f.ColorMessage || !f.showLevelText()) {
+			lines[i] = levelColor + lines[i] + reset
+		}
+	}
+	if padding := f.PadMessageTo - displayWidth(lines[len(lines)-1]); padding > 0 && len(fields) > 0 && !f.FieldsOnNewLine {
+		lines[len(lines)-1] += strings.Repeat(" ", padding)
+	}
+	message = strings.Join(lines, "\n"+indent)
+	if prefix != "" && message != "" {
+		parts = append(parts, prefix+messageSeparator+message)
+	} else if prefix != "" {
+		parts = append(parts, prefix)
+	} else if message != "" {
+		parts = append(parts, message)
+	}
+	b.WriteString(strings.Join(parts, " "))
+	// Fields follow the last line of a wrapped message.
+	if i := bytes.LastIndexByte(b.Bytes()[lineStart:], '\n'); i >= 0 {
+		lineStart += i + 1
+	}
+
+	if caller != nil {
+		callerColor := ansi.LightBlack
+		if colors.Caller != "" {
+			callerColor = colorCode(colors.Caller)
+		}
+		text := callerText(caller)
+		if f.CallerHyperlink {
+			text = hyperlink(fileURL(caller.File), text)
+		}
+		fmt.Fprintf(b, " %s%s%s", callerColor, text, reset)
+	}
+
+	fieldValueColor := ""
+	if colors.FieldValue != "" {
+		fieldValueColor = colorCode(colors.FieldValue)
+	}
+
+	separator := f.fieldSeparator()
+	kvSeparator := f.keyValueSeparator()
+	if colors.Equals != "" {
+		kvSeparator = colorCode(colors.Equals) + kvSeparator + reset
+	}
+	shown, hiddenFields := fields, 0
+	if f.MaxFields > 0 && len(shown) > f.MaxFields {
+		hiddenFields = len(shown) - f.MaxFields
+		shown = shown[:f.MaxFields]
+	}
+	rendered := make([]string, 0, len(shown)+1)
+	if f.FieldFormat == FieldFormatJSON && len(shown) > 0 {
+		rendered = append(rendered, separator+fieldsToJSON(shown))
+		shown = nil
+	}
+	var pretty []string
+	for _, field := range shown {
+		k, v := field.key, field.value
+		if value, ok := f.prettyValue(v); ok {
+			if fieldValueColor != "" {
+				// Color every line on its own, so that the color never bleeds
+				// into whatever follows the entry.
+				value = fieldValueColor + strings.Replace(value, "\n", reset+"\n"+fieldValueColor, -1) + reset
+			}
+			pretty = append(pretty, fmt.Sprintf("\n  %s%s%s%s%s", levelColor, k, reset, kvSeparator, value))
+			continue
+		}
+		if err, ok := v.(error); ok {
+			v = f.errorText(err)
+		} else if text, ok := stringerText(v); ok {
+			v = text
+		}
+		if text, ok := v.(string); ok && f.StripFieldANSI {
+			v = stripANSI(text)
+		}
+		if f.QuoteEmptyFields && isEmptyValue(v) {
+			v = `""`
+		} else if text, ok := v.(string); ok && (f.ForceQuote || f.alwaysQuoted(k)) {
+			v = fmt.Sprintf("%q", text)
+		}
+		value := fmt.Sprintf("%+v", v)
+		if !f.DisableControlCharEscaping {
+			value = escapeControlChars(value)
+		}
+		if fieldValueColor != "" {
+			rendered = append(rendered, fmt.Sprintf("%s%s%s%s%s%s%s%s", separator, levelColor, k, reset, kvSeparator, fieldValueColor, value, reset))
+		} else {
+			rendered = append(rendered, fmt.Sprintf("%s%s%s%s%s%s", separator, levelColor, k, reset, kvSeparator, value))
+		}
+	}
+	if hiddenFields > 0 {
+		rendered = append(rendered, fmt.Sprintf("%s%s(+%d more)%s", separator, ansi.LightBlack, hiddenFields, reset))
+	}
+
+	if f.FieldsOnNewLine && len(rendered) > 0 {
+		indent := f.FieldIndent
+		if indent == "" {
+			indent = "  "
+		}
+		b.WriteByte('\n')
+		lineStart = b.Len()
+		b.WriteString(indent)
+		rendered[0] = strings.TrimPrefix(rendered[0], separator)
+	}
+
+	maxLineWidth := f.MaxLineWidth
+	if maxLineWidth < 0 {
+		maxLineWidth = f.terminalWidth()
+	}
+	if maxLineWidth > 0 {
+		rendered = truncateFields(rendered, maxLineWidth-linePrefixWidth-displayWidth(b.String()[lineStart:]))
+	}
+
+	if f.RightAlignFields && len(rendered) > 0 {
+		width := maxLineWidth
+		if width <= 0 {
+			width = f.terminalWidth()
+		}
+		padding := width - linePrefixWidth - displayWidth(b.String()[lineStart:])
+		for _, field := range rendered {
+			padding -= displayWidth(field)
+		}
+		if width > 0 && padding > 0 {
+			b.WriteString(strings.Repeat(" ", padding))
+		}
+	}
+
+	for _, field := range rendered {
+		b.WriteString(field)
+	}
+	for _, field := range pretty {
+		b.WriteString(field)
+	}
+	return fields
+}
+
+// wrapWords breaks text into lines of at most width columns on spaces. Words
+// wider than that get a line of their own.
+func wrapWords(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && displayWidth(line)+1+displayWidth(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	return append(lines, line)
+}
+
+// colorForValue picks a color from the palette used by ColorByField.
+func colorForValue(value string) string {
+	return ColorForString(value, fieldColorPalette)
+}
+
+// ColorForString picks one of the ANSI color codes of palette based on an FNV
+// hash of s, so that the same string always gets the same color, across runs
+// as well. It returns an empty string for an empty palette.
+func ColorForString(s string, palette []string) string {
+	if len(palette) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// colorCode works like ansi.ColorCode but also accepts 24-bit colors written as
+// hex, e.g. "#ff8800+b:#202020". Malformed hex colors fall back to the default
+// color of the terminal.
+func colorCode(spec string) string {
+	if !strings.Contains(spec, "#") {
+		return ansi.ColorCode(spec)
+	}
+
+	sides := strings.SplitN(spec, ":", 2)
+	trueColors := ""
+	for i, side := range sides {
+		style := strings.SplitN(side, "+", 2)
+		if !strings.HasPrefix(style[0], "#") {
+			continue
+		}
+		if r, g, b, ok := parseHexColor(style[0]); ok {
+			// 38 selects the foreground, 48 the background.
+			trueColors += fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", 38+10*i, r, g, b)
+		}
+		style[0] = "default"
+		sides[i] = strings.Join(style, "+")
+	}
+	return ansi.ColorCode(strings.Join(sides, ":")) + trueColors
+}
+
+func parseHexColor(hex string) (r, g, b uint8, ok bool) {
+	if len(hex) == 4 {
+		hex = string([]byte{'#', hex[1], hex[1], hex[2], hex[2], hex[3], hex[3]})
+	}
+	if len(hex) != 7 {
+		return 0, 0, 0, false
+	}
+	rgb, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), true
+}
+
+// isColorSpec reports whether spec is a color style colorCode understands, i.e.
+// known color names, 256-color numbers or hex colors with optional attributes.
+func isColorSpec(spec string) bool {
+	sides := strings.Split(spec, ":")
+	if spec == "" || len(sides) > 2 {
+		return false
+	}
+	for i, side := range sides {
+		color := strings.SplitN(side, "+", 2)[0]
+		if color == "" && i > 0 {
+			continue
+		}
+		if strings.HasPrefix(color, "#") {
+			if _, _, _, ok := parseHexColor(color); !ok {
+				return false
+			}
+		} else if _, ok := ansi.Colors[color]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// truncateFields drops the trailing fields that don't fit into width columns
+// and marks the cut with an ellipsis.
+func truncateFields(fields []string, width int) []string {
+	total := 0
+	for _, field := range fields {
+		total += displayWidth(field)
+	}
+	if total <= width {
+		return fields
+	}
+
+	used := displayWidth(fieldsEllipsis)
+	for i, field := range fields {
+		used += displayWidth(field)
+		if used > width {
+			return append(fields[:i:i], fieldsEllipsis)
+		}
+	}
+	return fields
+}
+
+// displayWidth returns the number of terminal columns text takes up. ANSI
+// escape sequences take up none, and neither do combining marks, while wide
+// characters like CJK and most emoji take up two. So does a character followed
+// by VS16, which asks for its emoji presentation, like the one in "⚠️".
+func displayWidth(text string) int {
+	width, last := 0, 0
+	for _, r := range stripANSI(text) {
+		switch {
+		case r == '\ufe0f':
+			if last == 1 {
+				width, last = width+1, 2
+			}
+		case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), r == '\u200d', r >= '\ufe00' && r <= '\ufe0e':
+		case isWideRune(r):
+			width, last = width+2, 2
+		default:
+			width, last = width+1, 1
+		}
+	}
+	return width
+}
+
+// isWideRune reports whether r is in one of the main East Asian wide or
+// fullwidth blocks, or is an emoji that terminals render two columns wide.
+func isWideRune(r rune) bool {
+	switch {
+	case r < 0x1100:
+		return false
+	case r <= 0x115f, // Hangul Jamo
+		r >= 0x231a && r <= 0x231b, r >= 0x23e9 && r <= 0x23ec, r == 0x23f0, r == 0x23f3, // Emoji among the symbols
+		r >= 0x25fd && r <= 0x25fe, r >= 0x2614 && r <= 0x2615, r >= 0x2648 && r <= 0x2653,
+		r == 0x267f, r == 0x2693, r == 0x26a1, r >= 0x26aa && r <= 0x26ab, r >= 0x26bd && r <= 0x26be,
+		r >= 0x26c4 && r <= 0x26c5, r == 0x26ce, r == 0x26d4, r == 0x26ea, r >= 0x26f2 && r <= 0x26f3,
+		r == 0x26f5, r == 0x26fa, r == 0x26fd, r == 0x2705, r >= 0x270a && r <= 0x270b, r == 0x2728,
+		r == 0x274c, r == 0x274e, r >= 0x2753 && r <= 0x2755, r == 0x2757, r >= 0x2795 && r <= 0x2797,
+		r == 0x27b0, r == 0x27bf, r >= 0x2b1b && r <= 0x2b1c, r == 0x2b50, r == 0x2b55,
+		r >= 0x2e80 && r <= 0x303e, // CJK radicals and punctuation
+		r >= 0x3041 && r <= 0x33ff, // Kana, CJK compatibility
+		r >= 0x3400 && r <= 0x4dbf, // CJK extension A
+		r >= 0x4e00 && r <= 0x9fff, // CJK unified ideographs
+		r >= 0xa000 && r <= 0xa4cf, // Yi
+		r >= 0xac00 && r <= 0xd7a3, // Hangul syllables
+		r >= 0xf900 && r <= 0xfaff, // CJK compatibility ideographs
+		r >= 0xfe30 && r <= 0xfe4f, // CJK compatibility forms
+		r >= 0xff00 && r <= 0xff60, // Fullwidth forms
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f, // Emoji
+		r >= 0x1f680 && r <= 0x1f6ff,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x1fa70 && r <= 0x1faff,
+		r >= 0x20000 && r <= 0x3fffd: // CJK extensions B and beyond
+		return true
+	}
+	return false
+}
+
+func stripANSI(text string) string {
+	return ansiRegex.ReplaceAllString(text, "")
+}
+
+// WriteColorLegend writes a sample line for every level to w, rendered the way
+// the colored output renders entries, which is handy for previewing the
+// configured colors in the current terminal. Options that would hide the lines
+// or their level text, like SkipPrefixes or MinimalMode, are ignored, and the
+// lines are only colored if IsColored says so.
+func (f *TextFormatter) WriteColorLegend(w io.Writer) error {
+	legend := f.Clone()
+	legend.MinimalMode, legend.DisableLevelText = false, false
+	colored := f.IsColored()
+
+	b := &bytes.Buffer{}
+	for _, level := range logrus.AllLevels {
+		entry := &logrus.Entry{
+			Time:    time.Now(),
+			Level:   level,
+			Message: legendMessage,
+			Data:    logrus.Fields{f.prefixFieldName(): "legend"},
+		}
+		b.Reset()
+		legend.printColored(b, entry, nil, nil)
+		line := b.String()
+		if !colored {
+			line = stripANSI(line)
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getCaller returns the first stack frame outside of logrus and this package.
+// Frames are matched by package rather than by a fixed depth, so that logging
+// through hooks or helpers doesn't shift it.
+func getCaller() *runtime.Frame {
+	pcs := make([]uintptr, 32)
+	depth := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:depth])
+	for {
+		frame, more := frames.Next()
+		pkg := getPackageName(frame.Function)
+		if pkg != formatterPackage && pkg != logrusPackage && !strings.HasPrefix(pkg, logrusPackage+"/") {
+			return &frame
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// callerText returns the "file:line" location of the frame.
+func callerText(frame *runtime.Frame) string {
+	return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+}
+
+// hyperlink wraps text in an OSC 8 escape sequence linking it to url, which
+// many terminal emulators make clickable.
+func hyperlink(url, text string) string {
+	return "\x1b]8;;" + url + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+func fileURL(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "file://" + path
+}
+
+// getPackageName strips the function name off a fully qualified one, e.g.
+// "github.com/sirupsen/logrus.(*Entry).log" becomes "github.com/sirupsen/logrus".
+func getPackageName(function string) string {
+	slash := strings.LastIndex(function, "/")
+	if dot := strings.Index(function[slash+1:], "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
+}
+
+// alwaysQuoted reports whether key is one of AlwaysQuoteFields.
+func (f *TextFormatter) alwaysQuoted(key string) bool {
+	for _, k := range f.AlwaysQuoteFields {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *TextFormatter) needsQuoting(text string) bool {
+	if f.ForceQuote {
+		return true
+	}
+	if len(text) == 0 {
+		return f.QuoteEmptyFields
+	}
+	for _, ch := range text {
+		if !((ch >= 'a' && ch <= 'z') ||
+			(ch >= 'A' && ch <= 'Z') ||
+			(ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '.') {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *TextFormatter) extractPrefix(msg string) (string, string) {
+	regex := prefixRegex(f.PrefixStart, f.PrefixEnd)
+	var prefixes []string
+	for {
+		match := regex.FindStringSubmatch(msg)
+		if match == nil {
+			break
+		}
+		prefixes, msg = append(prefixes, match[1]), msg[len(match[0]):]
+		if !f.MergeNestedPrefixes {
+			break
+		}
+	}
+	if len(prefixes) == 0 {
+		return "", msg
+	}
+
+	separator := f.PrefixSeparator
+	if separator == "" {
+		separator = "/"
+	}
+	return strings.Join(prefixes, separator), strings.TrimSpace(msg)
+}
+
+// prefixRegex returns the compiled prefix pattern for the given delimiters,
+// compiling it only the first time a pair of delimiters is seen.
+func prefixRegex(start, end string) *regexp.Regexp {
+	if start == "" && end == "" {
+		return defaultPrefixRegex
+	}
+
+	key := [2]string{start, end}
+	prefixRegexesMu.RLock()
+	regex, ok := prefixRegexes[key]
+	prefixRegexesMu.RUnlock()
+	if ok {
+		return regex
+	}
+
+	regex = regexp.MustCompile("^" + regexp.QuoteMeta(start) + "(.*?)" + regexp.QuoteMeta(end))
+	prefixRegexesMu.Lock()
+	prefixRegexes[key] = regex
+	prefixRegexesMu.Unlock()
+	return regex
+}
+
+// printJSON writes the whole entry as a single JSON object, with the time,
+// level, msg, prefix and caller ahead of the fields.
+func (f *TextFormatter) printJSON(b *bytes.Buffer, entry *logrus.Entry, fields []field, caller *runtime.Frame) {
+	all := make([]field, 0, len(fields)+5)
+	if f.showTimestamp(entry.Level) {
+		all = append(all, field{"time", f.formatTime(entry.Time)})
+	}
+	if f.showLevelText() {
+		levelText := levelName(entry.Level)
+		if name, ok := f.LevelNames[entry.Level]; ok {
+			levelText = name
+		}
+		all = append(all, field{"level", levelText})
+	}
+	message := entry.Message
+	prefix, hasPrefix := entry.Data[f.prefixFieldName()]
+	if !hasPrefix {
+		if extracted, trimmedMsg := f.extractPrefix(message); extracted != "" {
+			prefix, message, hasPrefix = extracted, trimmedMsg, true
+		}
+	}
+	all = append(all, field{"msg", f.truncateMessage(message)})
+	if hasPrefix {
+		all = append(all, field{"prefix", prefix})
+	}
+	if caller != nil {
+		all = append(all, field{"caller", callerText(caller)})
+	}
+	// Unlike the time, msg and level keys, prefix and caller only clash when
+	// they're written, and only here.
+	for i := range fields {
+		switch trimFieldsPrefix(fields[i].key) {
+		case "prefix":
+			if hasPrefix {
+				fields[i].key = "fields." + fields[i].key
+			}
+		case "caller":
+			if caller != nil {
+				fields[i].key = "fields." + fields[i].key
+			}
+		}
+	}
+	b.WriteString(fieldsToJSON(append(all, fields...)))
+}
+
+// fieldsToJSON renders the fields as a JSON object, keeping their order.
+// Values that can't be encoded are rendered as strings instead.
+func fieldsToJSON(fields []field) string {
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+
+	b.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		encoder.Encode(field.key)
+		b.Truncate(b.Len() - 1)
+		b.WriteByte(':')
+
+		value := field.value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if encoder.Encode(value) != nil {
+			encoder.Encode(fmt.Sprint(value))
+		}
+		b.Truncate(b.Len() - 1)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeControlChars(text string) string {
+	return controlCharReplacer.Replace(text)
+}
+
+// prettyValue renders maps, slices and structs as indented JSON when
+// PrettyFields is set. Byte slices and values that can't be marshaled are left
+// to the usual formatting.
+func (f *TextFormatter) prettyValue(value interface{}) (string, bool) {
+	if !f.PrettyFields || value == nil {
+		return "", false
+	}
+	t := reflect.TypeOf(value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Array, reflect.Struct:
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	serialized, err := json.MarshalIndent(value, "  ", "  ")
+	if err != nil {
+		return "", false
+	}
+	return string(serialized), true
+}
+
+// stringerText returns the String() of value if it implements fmt.Stringer, so
+// that both outputs quote, strip and escape it like a string. Nil pointers are
+// left to fmt, which prints them as <nil>.
+func stringerText(value interface{}) (string, bool) {
+	stringer, ok := value.(fmt.Stringer)
+	if !ok {
+		return "", false
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
+		return "", false
+	}
+	return stringer.String(), true
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch value := value.(type) {
+	case string:
+		return value == ""
+	case error:
+		return value.Error() == ""
+	}
+	return false
+}
+
+func (f *TextFormatter) appendKeyValue(b *bytes.Buffer, key string, value interface{}) {
+	b.WriteString(key)
+	b.WriteString(f.keyValueSeparator())
+
+	if text, ok := stringerText(value); ok {
+		if _, isError := value.(error); !isError {
+			value = text
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		if f.StripFieldANSI {
+			value = stripANSI(value)
+		}
+		if f.needsQuoting(value) || f.alwaysQuoted(key) {
+			fmt.Fprintf(b, "%q", value)
+		} else {
+			b.WriteString(value)
+		}
+	case error:
+		errmsg := f.errorText(value)
+		if f.StripFieldANSI {
+			errmsg = stripANSI(errmsg)
+		}
+		if f.needsQuoting(errmsg) || f.alwaysQuoted(key) {
+			fmt.Fprintf(b, "%q", errmsg)
+		} else {
+			b.WriteString(errmsg)
+		}
+	default:
+		text := fmt.Sprint(value)
+		if !f.DisableControlCharEscaping {
+			text = escapeControlChars(text)
+		}
+		b.WriteString(text)
+	}
+
+	b.WriteString(f.fieldSeparator())
+}
+
+// errorText renders err with %+v when ExpandErrors is set, which includes the
+// stack traces of errors that support it.
+func (f *TextFormatter) errorText(err error) string {
+	if f.ExpandErrors {
+		return fmt.Sprintf("%+v", err)
+	}
+	return err.Error()
+}
+
+// keyValueSeparator returns KeyValueSeparator, falling back to "=" when it's
+// empty.
+func (f *TextFormatter) keyValueSeparator() string {
+	if f.KeyValueSeparator == "" {
+		return "="
+	}
+	return f.KeyValueSeparator
+}
+
+// timestampDelimiters returns TimestampPrefix and TimestampSuffix, falling back
+// to square brackets when both are empty, or nothing at all with
+// DisableTimestampDelimiters.
+func (f *TextFormatter) timestampDelimiters() (string, string) {
+	if f.DisableTimestampDelimiters {
+		return "", ""
+	}
+	if f.TimestampPrefix == "" && f.TimestampSuffix == "" {
+		return "[", "]"
+	}
+	return f.TimestampPrefix, f.TimestampSuffix
+}
+
+// prefixSuffix returns PrefixSuffix, falling back to ":" when it's empty, or
+// nothing at all with DisablePrefixSuffix.
+func (f *TextFormatter) prefixSuffix() string {
+	if f.DisablePrefixSuffix {
+		return ""
+	}
+	if f.PrefixSuffix == "" {
+		return ":"
+	}
+	return f.PrefixSuffix
+}
+
+// prefixFieldName returns PrefixFieldName, falling back to "prefix" when it's
+// empty.
+func (f *TextFormatter) prefixFieldName() string {
+	if f.PrefixFieldName == "" {
+		return "prefix"
+	}
+	return f.PrefixFieldName
+}
+
+// colorFieldName returns ColorFieldName, falling back to "_color" when it's
+// empty.
+func (f *TextFormatter) colorFieldName() string {
+	if f.ColorFieldName == "" {
+		return "_color"
+	}
+	return f.ColorFieldName
+}
+
+// fieldSeparator returns FieldSeparator, falling back to a single space when
+// it's empty.
+func (f *TextFormatter) fieldSeparator() string {
+	if f.FieldSeparator == "" {
+		return " "
+	}
+	return f.FieldSeparator
+}
+
+// prefixFieldClashes renames the fields whose keys clash with the time, msg and
+// level keys of the plain and JSON outputs to "fields.time" and so on, keeping
+// their place. Keys that look renamed already are prefixed once more, e.g.
+// "fields.time" to "fields.fields.time", so that Parse can tell them apart.
+func prefixFieldClashes(fields []field) {
+	for i := range fields {
+		if isFieldClash(trimFieldsPrefix(fields[i].key)) {
+			fields[i].key = "fields." + fields[i].key
+		}
+	}
+}
+
+// trimFieldsPrefix strips all the "fields." prefixes off key.
+func trimFieldsPrefix(key string) string {
+	for strings.HasPrefix(key, "fields.") {
+		key = strings.TrimPrefix(key, "fields.")
+	}
+	return key
+}
+
+func isFieldClash(key string) bool {
+	switch key {
+	case "time", "msg", "level":
+		return true
+	}
+	return false
+}
+
+// levelPadding returns LevelPadding, falling back to 5, or 1 with LevelLetter,
+// when it's zero and to no padding at all when it's negative.
+func (f *TextFormatter) levelPadding() int {
+	switch {
+	case f.LevelPadding == 0 && f.LevelLetter:
+		return 1
+	case f.LevelPadding == 0:
+		return 5
+	case f.LevelPadding < 0:
+		return 0
+	}
+	return f.LevelPadding
+}
+
+// shortTimestampPadding returns ShortTimestampPadding, falling back to 4 when
+// it's zero and to no padding at all when it's negative.
+func (f *TextFormatter) shortTimestampPadding() int {
+	switch {
+	case f.ShortTimestampPadding == 0:
+		return 4
+	case f.ShortTimestampPadding < 0:
+		return 0
 	}
+	return f.ShortTimestampPadding
 }
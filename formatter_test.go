@@ -0,0 +1,2072 @@
+package prefixed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mgutz/ansi"
+	"github.com/sirupsen/logrus"
+)
+
+var testTime = time.Date(2006, time.January, 12, 15, 4, 5, 0, time.Local)
+
+func newEntry(level logrus.Level, message string, data logrus.Fields) *logrus.Entry {
+	if data == nil {
+		data = logrus.Fields{}
+	}
+	return &logrus.Entry{Data: data, Time: testTime, Level: level, Message: message}
+}
+
+func format(t *testing.T, f *TextFormatter, entry *logrus.Entry) string {
+	t.Helper()
+	serialized, err := f.Format(entry)
+	if err != nil {
+		t.Fatalf("Format() returned an error: %v", err)
+	}
+	return string(serialized)
+}
+
+func TestLevelPadding(t *testing.T) {
+	tests := []struct {
+		padding int
+		level   logrus.Level
+		want    string
+	}{
+		{0, logrus.InfoLevel, " INFO"},
+		{0, logrus.DebugLevel, "DEBUG"},
+		{-1, logrus.InfoLevel, "INFO"},
+		{3, logrus.InfoLevel, "INFO"},
+		{7, logrus.InfoLevel, "   INFO"},
+		{7, logrus.DebugLevel, "  DEBUG"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, LevelPadding: test.padding, Colors: &Colors{}}
+		entry := newEntry(test.level, "msg", nil)
+		color := ansi.Blue
+		if test.level == logrus.DebugLevel {
+			color = ansi.White
+		}
+		want := color + test.want + ansi.Reset + " msg\n"
+		if got := format(t, f, entry); !strings.HasSuffix(got, want) {
+			t.Errorf("LevelPadding %d: got %q, want it to end in %q", test.padding, got, want)
+		}
+	}
+}
+
+func TestLevelNames(t *testing.T) {
+	full := map[logrus.Level]string{
+		logrus.DebugLevel: "DBG",
+		logrus.InfoLevel:  "INF",
+		logrus.WarnLevel:  "WRN",
+		logrus.ErrorLevel: "ERR",
+		logrus.FatalLevel: "FTL",
+		logrus.PanicLevel: "PNC",
+	}
+	colors := map[logrus.Level]string{
+		logrus.DebugLevel: ansi.White,
+		logrus.InfoLevel:  ansi.Blue,
+		logrus.WarnLevel:  ansi.Yellow,
+		logrus.ErrorLevel: ansi.Red,
+		logrus.FatalLevel: ansi.Red,
+		logrus.PanicLevel: ansi.Red,
+	}
+	for level, name := range full {
+		f := &TextFormatter{DisableColors: true, DisableTimestamp: true, LevelNames: full}
+		want := "level=" + name + " msg=msg \n"
+		if got := format(t, f, newEntry(level, "msg", nil)); got != want {
+			t.Errorf("plain %s: got %q, want %q", level, got, want)
+		}
+
+		f = &TextFormatter{ForceColors: true, LevelNames: full, Colors: &Colors{}}
+		want = colors[level] + "  " + name + ansi.Reset + " msg\n"
+		if got := format(t, f, newEntry(level, "msg", nil)); !strings.HasSuffix(got, want) {
+			t.Errorf("colored %s: got %q, want it to end in the padded %q", level, got, want)
+		}
+	}
+
+	partial := map[logrus.Level]string{logrus.WarnLevel: "careful"}
+	f := &TextFormatter{ForceColors: true, LevelNames: partial, Colors: &Colors{}}
+	if got := format(t, f, newEntry(logrus.WarnLevel, "msg", nil)); !strings.HasSuffix(got, ansi.Yellow+"careful"+ansi.Reset+" msg\n") {
+		t.Errorf("partial map, mapped level: got %q", got)
+	}
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "msg", nil)); !strings.HasSuffix(got, ansi.Red+"ERROR"+ansi.Reset+" msg\n") {
+		t.Errorf("partial map, unmapped level: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, LevelNames: partial}
+	if got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)); got != "level=info msg=msg \n" {
+		t.Errorf("partial map, plain unmapped level: got %q", got)
+	}
+}
+
+func TestWriteColorLegend(t *testing.T) {
+	formatters := map[string]*TextFormatter{
+		"default":          {ForceColors: true, DisableTimestamp: true},
+		"SkipPrefixes":     {ForceColors: true, DisableTimestamp: true, SkipPrefixes: []string{"legend"}},
+		"OnlyFields":       {ForceColors: true, DisableTimestamp: true, OnlyFields: []string{"request_id"}},
+		"MinimalMode":      {ForceColors: true, DisableTimestamp: true, MinimalMode: true},
+		"DisableLevelText": {ForceColors: true, DisableTimestamp: true, DisableLevelText: true},
+	}
+	for name, f := range formatters {
+		var b bytes.Buffer
+		if err := f.WriteColorLegend(&b); err != nil {
+			t.Fatalf("%s: WriteColorLegend() returned an error: %v", name, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		if len(lines) != len(logrus.AllLevels) {
+			t.Fatalf("%s: got %d lines, want one per level: %q", name, len(lines), b.String())
+		}
+		want := ansi.Blue + " INFO" + ansi.Reset + " " + ansi.LightBlack + "(legend):" + ansi.Reset + " " + legendMessage
+		if !containsLine(lines, want) {
+			t.Errorf("%s: no info line %q in %q", name, want, lines)
+		}
+	}
+
+	// The lines are styled like entries are.
+	f := &TextFormatter{
+		ForceColors:      true,
+		DisableTimestamp: true,
+		Colors:           &Colors{Warn: "magenta"},
+		LevelNames:       map[logrus.Level]string{logrus.InfoLevel: "INF"},
+		LevelPadding:     4,
+		LevelBackground:  true,
+		PrefixColors:     map[string]string{"legend": "green"},
+		PrefixSuffix:     " >",
+	}
+	var b bytes.Buffer
+	f.WriteColorLegend(&b)
+	for _, want := range []string{
+		ansi.Magenta + "\x1b[7m" + "WARN" + ansi.Reset + " ",
+		ansi.Blue + "\x1b[7m" + " INF" + ansi.Reset + " " + ansi.Green + "(legend) >" + ansi.Reset + " " + legendMessage + "\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("no %q in %q", want, b.String())
+		}
+	}
+
+	f = &TextFormatter{DisableColors: true}
+	b.Reset()
+	f.WriteColorLegend(&b)
+	if strings.Contains(b.String(), "\x1b") {
+		t.Errorf("DisableColors: got escape sequences in %q", b.String())
+	}
+	if !strings.Contains(b.String(), "] ERROR (legend): "+legendMessage+"\n") {
+		t.Errorf("DisableColors: no plain error line with a timestamp in %q", b.String())
+	}
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPrefixDelimiters(t *testing.T) {
+	tests := []struct {
+		start, end string
+		message    string
+		prefix     string
+		rest       string
+	}{
+		{"", "", "[main] Started", "main", "Started"},
+		{"[", "]", "[main] Started", "main", "Started"},
+		{"(", ")", "(main) Started", "main", "Started"},
+		{"<", ">", "<main> Started", "main", "Started"},
+		{"", " |", "main | Started", "main", "Started"},
+		{"(", ")", "[main] Started", "", "[main] Started"},
+		{".*", "+", ".*main+ Started", "main", "Started"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{PrefixStart: test.start, PrefixEnd: test.end}
+		prefix, rest := f.extractPrefix(test.message)
+		if prefix != test.prefix || rest != test.rest {
+			t.Errorf("%q with %q and %q: got %q, %q, want %q, %q", test.message, test.start, test.end, prefix, rest, test.prefix, test.rest)
+		}
+	}
+
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrefixStart: "<", PrefixEnd: ">", Colors: &Colors{}}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "<db> Connected", nil))); !strings.HasSuffix(got, " INFO (db): Connected\n") {
+		t.Errorf("colored output: got %q", got)
+	}
+}
+
+func TestPrefixRegexCached(t *testing.T) {
+	if prefixRegex("", "") != defaultPrefixRegex {
+		t.Error("default delimiters don't use the precompiled regex")
+	}
+	if prefixRegex("(", ")") != prefixRegex("(", ")") {
+		t.Error("regex recompiled for the same delimiters")
+	}
+	if prefixRegex("(", ")") == prefixRegex("<", ">") {
+		t.Error("same regex used for different delimiters")
+	}
+}
+
+func BenchmarkFormatWithPrefixExtraction(b *testing.B) {
+	f := &TextFormatter{ForceColors: true, PrefixStart: "(", PrefixEnd: ")"}
+	entry := newEntry(logrus.InfoLevel, "(main) Started observing beach", logrus.Fields{"animal": "walrus"})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f.Format(entry)
+	}
+}
+
+func TestNeedsQuoting(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"simple", false},
+		{"with-dash.and.dots42", false},
+		{"with space", true},
+		{`with"quote`, true},
+		{"key=value", true},
+		{"tab\there", true},
+		{"ünïcode", true},
+		{"日本", true},
+		{"", false},
+	}
+	f := &TextFormatter{}
+	for _, test := range tests {
+		if got := f.needsQuoting(test.text); got != test.want {
+			t.Errorf("needsQuoting(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestAppendKeyValueQuoting(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"simple", "k=simple "},
+		{"with space", `k="with space" `},
+		{`say "hi"`, `k="say \"hi\"" `},
+		{"a=b", `k="a=b" `},
+		{"ünïcode", `k="ünïcode" `},
+		{errors.New("failed badly"), `k="failed badly" `},
+		{42, "k=42 "},
+	}
+	f := &TextFormatter{}
+	for _, test := range tests {
+		var b bytes.Buffer
+		f.appendKeyValue(&b, "k", test.value)
+		if got := b.String(); got != test.want {
+			t.Errorf("appendKeyValue(%#v): got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestQuoteEmptyFields(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"key": "", "next": "val"})
+	tests := []struct {
+		quote  bool
+		fields string
+	}{
+		{true, `key="" next=val`},
+		{false, "key= next=val"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{DisableColors: true, DisableTimestamp: true, QuoteEmptyFields: test.quote}
+		if got := format(t, f, entry); got != "level=info msg=msg "+test.fields+" \n" {
+			t.Errorf("plain, QuoteEmptyFields %v: got %q", test.quote, got)
+		}
+		f = &TextFormatter{ForceColors: true, DisableTimestamp: true, QuoteEmptyFields: test.quote, Colors: &Colors{}}
+		if got := stripANSI(format(t, f, entry)); !strings.HasSuffix(got, " INFO msg "+test.fields+"\n") {
+			t.Errorf("colored, QuoteEmptyFields %v: got %q", test.quote, got)
+		}
+	}
+
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, QuoteEmptyFields: true}
+	if got := format(t, f, newEntry(logrus.InfoLevel, "msg", logrus.Fields{"err": errors.New("")})); got != `level=info msg=msg err="" `+"\n" {
+		t.Errorf("empty error: got %q", got)
+	}
+}
+
+func TestFieldValueColor(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": "two"})
+	gray := ansi.ColorCode("240")
+
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: &Colors{FieldValue: "240"}}
+	want := ansi.Blue + " INFO" + ansi.Reset + " msg" +
+		" " + ansi.Blue + "a" + ansi.Reset + "=" + gray + "1" + ansi.Reset +
+		" " + ansi.Blue + "b" + ansi.Reset + "=" + gray + "two" + ansi.Reset + "\n"
+	if got := format(t, f, entry); !strings.HasSuffix(got, want) {
+		t.Errorf("with FieldValue: got %q, want %q", got, want)
+	}
+
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: &Colors{}}
+	want = ansi.Blue + " INFO" + ansi.Reset + " msg" +
+		" " + ansi.Blue + "a" + ansi.Reset + "=1" +
+		" " + ansi.Blue + "b" + ansi.Reset + "=two\n"
+	if got := format(t, f, entry); !strings.HasSuffix(got, want) {
+		t.Errorf("without FieldValue: got %q, want %q", got, want)
+	}
+}
+
+func TestNewFormatter(t *testing.T) {
+	f := NewFormatter()
+	if f.Colors == nil {
+		t.Error("Colors is nil")
+	}
+	if f.TimestampFormat != time.Stamp {
+		t.Errorf("TimestampFormat = %q, want time.Stamp", f.TimestampFormat)
+	}
+	if f.LevelPadding != 5 {
+		t.Errorf("LevelPadding = %d, want 5", f.LevelPadding)
+	}
+}
+
+func TestZeroValueColored(t *testing.T) {
+	f := &TextFormatter{ForceColors: true}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); !strings.HasSuffix(got, " INFO msg\n") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestNilColors(t *testing.T) {
+	defaults := map[logrus.Level]string{
+		logrus.DebugLevel: ansi.White,
+		logrus.InfoLevel:  ansi.Blue,
+		logrus.WarnLevel:  ansi.Yellow,
+		logrus.ErrorLevel: ansi.Red,
+		logrus.FatalLevel: ansi.Red,
+		logrus.PanicLevel: ansi.Red,
+	}
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true}
+	for level, color := range defaults {
+		got := format(t, f, newEntry(level, "msg", logrus.Fields{"prefix": "main"}))
+		if !strings.HasPrefix(got, color) {
+			t.Errorf("%s: got %q, want it colored %q", level, got, color)
+		}
+		if !strings.Contains(got, ansi.LightBlack+"(main)") {
+			t.Errorf("%s: got %q, want the default prefix color", level, got)
+		}
+	}
+}
+
+func TestMaxLineWidth(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": 2, "c": 3})
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{0, " INFO msg a=1 b=2 c=3\n"},
+		{21, " INFO msg a=1 b=2 c=3\n"},
+		{20, " INFO msg a=1 b=2 …\n"},
+		{16, " INFO msg a=1 …\n"},
+		{14, " INFO msg …\n"},
+		{5, " INFO msg …\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, MaxLineWidth: test.width}
+		if got := stripANSI(format(t, f, entry)); got != test.want {
+			t.Errorf("MaxLineWidth %d: got %q, want %q", test.width, got, test.want)
+		}
+	}
+}
+
+func TestSortFunc(t *testing.T) {
+	var sorted []string
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, SortFunc: func(keys []string) {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		sorted = append([]string(nil), keys...)
+	}}
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": 2, "c": 3, "prefix": "main"})
+	if got := format(t, f, entry); got != "level=info msg=msg c=3 b=2 a=1 \n" {
+		t.Errorf("plain: got %q", got)
+	}
+	if strings.Join(sorted, ",") != "c,b,a" {
+		t.Errorf("SortFunc got keys %q, want them without the prefix", sorted)
+	}
+
+	f.DisableColors, f.ForceColors = false, true
+	if got := stripANSI(format(t, f, entry)); !strings.HasSuffix(got, "msg c=3 b=2 a=1\n") {
+		t.Errorf("colored: got %q", got)
+	}
+}
+
+func TestShortTimestamp(t *testing.T) {
+	tests := []struct {
+		unit    time.Duration
+		padding int
+		elapsed time.Duration
+		want    int
+		width   int
+	}{
+		{0, 0, 42 * time.Second, 42, 4},
+		{time.Second, 6, 42 * time.Second, 42, 6},
+		{time.Second, -1, 42 * time.Second, 42, 2},
+		{time.Millisecond, 0, 1500 * time.Millisecond, 1500, 4},
+		{time.Millisecond, 0, 42 * time.Millisecond, 42, 4},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, ShortTimestamp: true, ShortTimestampUnit: test.unit, ShortTimestampPadding: test.padding}
+		// Pretend the formatter was first used test.elapsed ago.
+		f.baseTimestamp.Store(time.Now().Add(-test.elapsed))
+		timestamp := strings.Trim(strings.Fields(stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))))[0], "[]")
+		elapsed, err := strconv.Atoi(timestamp)
+		// Allow for the milliseconds passing while the test runs.
+		if err != nil || elapsed < test.want || elapsed > test.want+50 || len(timestamp) != test.width {
+			t.Errorf("%v elapsed in %v padded to %d: got %q, want %d in %d digits", test.elapsed, test.unit, test.padding, timestamp, test.want, test.width)
+		}
+	}
+}
+
+func TestResetTimer(t *testing.T) {
+	f := &TextFormatter{ShortTimestamp: true}
+	f.baseTimestamp.Store(time.Now().Add(-time.Hour))
+	other := &TextFormatter{ShortTimestamp: true}
+
+	if elapsed := f.miniTS(); elapsed < 3600 {
+		t.Errorf("before ResetTimer: got %d seconds, want at least an hour", elapsed)
+	}
+	if elapsed := other.miniTS(); elapsed != 0 {
+		t.Errorf("another formatter shares the base timestamp: got %d seconds", elapsed)
+	}
+	f.ResetTimer()
+	if elapsed := f.miniTS(); elapsed != 0 {
+		t.Errorf("after ResetTimer: got %d seconds, want 0", elapsed)
+	}
+}
+
+func TestForceQuote(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"k": "simple", "n": 1})
+	tests := []struct {
+		force          bool
+		plain, colored string
+	}{
+		{true, `level="info" msg="msg" k="simple" n=1 ` + "\n", ` INFO msg k="simple" n=1` + "\n"},
+		{false, "level=info msg=msg k=simple n=1 \n", " INFO msg k=simple n=1\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{DisableColors: true, DisableTimestamp: true, ForceQuote: test.force}
+		if got := format(t, f, entry); got != test.plain {
+			t.Errorf("plain, ForceQuote %v: got %q, want %q", test.force, got, test.plain)
+		}
+		f = &TextFormatter{ForceColors: true, DisableTimestamp: true, ForceQuote: test.force}
+		if got := stripANSI(format(t, f, entry)); got != test.colored {
+			t.Errorf("colored, ForceQuote %v: got %q, want %q", test.force, got, test.colored)
+		}
+	}
+}
+
+func TestDisableLevelText(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableLevelText: true}
+	entry := newEntry(logrus.ErrorLevel, "failed", logrus.Fields{"prefix": "main", "k": "v"})
+	got := format(t, f, entry)
+	if plain := stripANSI(got); strings.Contains(plain, "ERROR") || strings.Contains(plain, "  ") || strings.HasPrefix(plain, " ") {
+		t.Errorf("got %q, want no level text and single spaces", plain)
+	}
+	if !strings.Contains(got, ansi.Red+"failed"+ansi.Reset) {
+		t.Errorf("got %q, want the message in the level color", got)
+	}
+
+	f.DisableTimestamp = true
+	if got := stripANSI(format(t, f, entry)); !strings.HasPrefix(got, "(main)") {
+		t.Errorf("without timestamp: got %q", got)
+	}
+
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, DisableLevelText: true}
+	if got := format(t, f, entry); got != "msg=failed k=v \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestColorMessage(t *testing.T) {
+	colors := map[logrus.Level]string{
+		logrus.DebugLevel: ansi.White,
+		logrus.InfoLevel:  ansi.Blue,
+		logrus.WarnLevel:  ansi.Yellow,
+		logrus.ErrorLevel: ansi.Red,
+		logrus.FatalLevel: ansi.Red,
+		logrus.PanicLevel: ansi.Red,
+	}
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, ColorMessage: true}
+	for level, color := range colors {
+		got := format(t, f, newEntry(level, "[db] Connection lost", nil))
+		if !strings.Contains(got, ansi.LightBlack+"(db)") {
+			t.Errorf("%s: got %q, want the prefix in its own color", level, got)
+		}
+		if !strings.HasSuffix(got, " "+color+"Connection lost"+ansi.Reset+"\n") {
+			t.Errorf("%s: got %q, want the message colored %q", level, got, color)
+		}
+	}
+
+	f.ColorMessage = false
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "Connection lost", nil)); !strings.HasSuffix(got, ansi.Reset+" Connection lost\n") {
+		t.Errorf("without ColorMessage: got %q", got)
+	}
+}
+
+func TestStripFieldANSI(t *testing.T) {
+	if got := stripANSI("\x1b[31mred\x1b[0m and \x1b[1;38;5;208mbold\x1b[m"); got != "red and bold" {
+		t.Errorf("stripANSI: got %q", got)
+	}
+
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": "\x1b[31mred\x1b[0m", "b": "plain"})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, StripFieldANSI: true}
+	want := " " + ansi.Blue + "a" + ansi.Reset + "=red " + ansi.Blue + "b" + ansi.Reset + "=plain\n"
+	if got := format(t, f, entry); !strings.HasSuffix(got, want) {
+		t.Errorf("colored: got %q, want it to end in %q", got, want)
+	}
+
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, StripFieldANSI: true}
+	if got := format(t, f, entry); got != "level=info msg=msg a=red b=plain \n" {
+		t.Errorf("plain: got %q", got)
+	}
+
+	// Errors and Stringers are stripped once they've been turned into text.
+	entry = newEntry(logrus.InfoLevel, "msg", logrus.Fields{"e": errors.New("\x1b[31mboom\x1b[0m"), "s": greenText("ok")})
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, StripFieldANSI: true}
+	want = " " + ansi.Blue + "e" + ansi.Reset + "=boom " + ansi.Blue + "s" + ansi.Reset + "=ok\n"
+	if got := format(t, f, entry); !strings.HasSuffix(got, want) {
+		t.Errorf("colored error and Stringer: got %q, want it to end in %q", got, want)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, StripFieldANSI: true}
+	if got := format(t, f, entry); got != "level=info msg=msg e=boom s=ok \n" {
+		t.Errorf("plain error and Stringer: got %q", got)
+	}
+}
+
+type greenText string
+
+func (s greenText) String() string { return ansi.Green + string(s) + ansi.Reset }
+
+func TestColorCodeHex(t *testing.T) {
+	tests := []struct {
+		spec, want string
+	}{
+		{"#ff8800", ansi.ColorCode("default") + "\x1b[38;2;255;136;0m"},
+		{"#f80", ansi.ColorCode("default") + "\x1b[38;2;255;136;0m"},
+		{"#ff8800+b", ansi.ColorCode("default+b") + "\x1b[38;2;255;136;0m"},
+		{"white:#202020", ansi.ColorCode("white:default") + "\x1b[48;2;32;32;32m"},
+		{"#ff8800:#202020", ansi.ColorCode("default:default") + "\x1b[38;2;255;136;0m\x1b[48;2;32;32;32m"},
+		{"#ff88", ansi.ColorCode("default")},
+		{"#gg8800", ansi.ColorCode("default")},
+		{"red", ansi.ColorCode("red")},
+	}
+	for _, test := range tests {
+		if got := colorCode(test.spec); got != test.want {
+			t.Errorf("colorCode(%q) = %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+// setColorEnv sets the environment variables IsColored consults, restoring
+// them when the test ends.
+func setColorEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	// Cleanups run last in, first out, so this one sees the restored variables.
+	t.Cleanup(loadColorEnv)
+	for _, name := range []string{"NO_COLOR", "CLICOLOR_FORCE", "FORCE_COLOR"} {
+		name := name
+		if old, ok := os.LookupEnv(name); ok {
+			t.Cleanup(func() { os.Setenv(name, old) })
+		} else {
+			t.Cleanup(func() { os.Unsetenv(name) })
+		}
+		os.Unsetenv(name)
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	loadColorEnv()
+}
+
+func TestNoColor(t *testing.T) {
+	tests := []struct {
+		noColor string
+		f       TextFormatter
+		want    bool
+	}{
+		{"", TextFormatter{ForceColors: true}, true},
+		{"1", TextFormatter{ForceColors: true}, false},
+		{"1", TextFormatter{Output: &bytes.Buffer{}}, false},
+	}
+	for _, test := range tests {
+		t.Run("NO_COLOR="+test.noColor, func(t *testing.T) {
+			setColorEnv(t, map[string]string{"NO_COLOR": test.noColor})
+			if got := test.f.IsColored(); got != test.want {
+				t.Errorf("IsColored() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestColorEnvPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		f    TextFormatter
+		want bool
+	}{
+		{"no TTY", nil, TextFormatter{}, false},
+		{"CLICOLOR_FORCE", map[string]string{"CLICOLOR_FORCE": "1"}, TextFormatter{}, true},
+		{"FORCE_COLOR", map[string]string{"FORCE_COLOR": "true"}, TextFormatter{}, true},
+		{"FORCE_COLOR=0", map[string]string{"FORCE_COLOR": "0"}, TextFormatter{}, false},
+		{"CLICOLOR_FORCE=false", map[string]string{"CLICOLOR_FORCE": "false"}, TextFormatter{}, false},
+		{"ForceColors", nil, TextFormatter{ForceColors: true}, true},
+		{"FORCE_COLOR and DisableColors", map[string]string{"FORCE_COLOR": "1"}, TextFormatter{DisableColors: true}, false},
+		{"ForceColors and DisableColors", nil, TextFormatter{ForceColors: true, DisableColors: true}, false},
+		{"FORCE_COLOR and NO_COLOR", map[string]string{"FORCE_COLOR": "1", "NO_COLOR": "1"}, TextFormatter{}, false},
+		{"ForceColors and NO_COLOR", map[string]string{"NO_COLOR": "1"}, TextFormatter{ForceColors: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setColorEnv(t, test.env)
+			test.f.Output = &bytes.Buffer{}
+			if got := test.f.IsColored(); got != test.want {
+				t.Errorf("IsColored() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// Run with -race to catch Format writing to the entry or the formatter.
+func TestFormatConcurrently(t *testing.T) {
+	f := &TextFormatter{ForceColors: true}
+	entry := newEntry(logrus.InfoLevel, "[main] msg", logrus.Fields{"time": "now", "msg": "clash", "k": 1})
+	want := stripANSI(format(t, f, entry))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				serialized, err := f.Format(entry)
+				if err != nil || stripANSI(string(serialized)) != want {
+					t.Errorf("got %q, %v, want %q", serialized, err, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(entry.Data) != 3 {
+		t.Errorf("entry data changed to %v", entry.Data)
+	}
+}
+
+func TestFieldClashes(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"time": "now", "level": 3, "a": 1})
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	want := "level=info msg=msg a=1 fields.level=3 fields.time=now \n"
+	for i := 0; i < 2; i++ {
+		if got := format(t, f, entry); got != want {
+			t.Errorf("plain, round %d: got %q, want %q", i, got, want)
+		}
+	}
+	if len(entry.Data) != 3 || entry.Data["time"] != "now" || entry.Data["level"] != 3 {
+		t.Errorf("entry data changed to %v", entry.Data)
+	}
+
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true}
+	if got := stripANSI(format(t, f, entry)); got != " INFO msg a=1 level=3 time=now\n" {
+		t.Errorf("colored: got %q, want the keys as they are", got)
+	}
+
+	// Keys that look renamed already are renamed, too, so that they can't
+	// end up clashing with the renamed ones.
+	entry = newEntry(logrus.InfoLevel, "msg", logrus.Fields{"time": 1, "fields.time": 2})
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	if got := format(t, f, entry); got != "level=info msg=msg fields.fields.time=2 fields.time=1 \n" {
+		t.Errorf("taken key: got %q", got)
+	}
+	f.SortFunc = sort.Strings
+	if got := format(t, f, entry); got != "level=info msg=msg fields.fields.time=2 fields.time=1 \n" {
+		t.Errorf("taken key with SortFunc: got %q", got)
+	}
+}
+
+func TestFormatReturnsStableBytes(t *testing.T) {
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	first, _ := f.Format(newEntry(logrus.InfoLevel, "first", nil))
+	want := string(first)
+	f.Format(newEntry(logrus.InfoLevel, "second, which is longer", nil))
+	if string(first) != want {
+		t.Errorf("pooled buffer reused: got %q, want %q", first, want)
+	}
+}
+
+func BenchmarkFormat(b *testing.B) {
+	f := &TextFormatter{ForceColors: true}
+	entry := newEntry(logrus.InfoLevel, "Started observing beach", logrus.Fields{"prefix": "main", "animal": "walrus", "number": 8})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f.Format(entry)
+	}
+}
+
+func TestPadMessageTo(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PadMessageTo: 12}
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"short", " INFO short        k=v\n"},
+		{"exactly12chr", " INFO exactly12chr k=v\n"},
+		{"a much longer message", " INFO a much longer message k=v\n"},
+	}
+	for _, test := range tests {
+		got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, test.message, logrus.Fields{"k": "v"})))
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.message, got, test.want)
+		}
+	}
+
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "short", nil))); got != " INFO short\n" {
+		t.Errorf("without fields: got %q, want no padding", got)
+	}
+
+	f.FieldsOnNewLine = true
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "short", logrus.Fields{"k": "v"}))); got != " INFO short\n  k=v\n" {
+		t.Errorf("FieldsOnNewLine: got %q, want no padding", got)
+	}
+}
+
+func TestDisableNewline(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"k": "v"})
+	for _, colored := range []bool{false, true} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, DisableTimestamp: true}
+		if got := format(t, f, entry); strings.Count(got, "\n") != 1 || !strings.HasSuffix(got, "\n") {
+			t.Errorf("colored %v: got %q, want a single trailing newline", colored, got)
+		}
+		f.DisableNewline = true
+		if got := format(t, f, entry); strings.Contains(got, "\n") {
+			t.Errorf("colored %v with DisableNewline: got %q", colored, got)
+		}
+	}
+}
+
+func TestPrefixPadding(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrefixPadding: 12}
+	entries := []*logrus.Entry{
+		newEntry(logrus.InfoLevel, "msg", logrus.Fields{"prefix": "db"}),
+		newEntry(logrus.InfoLevel, "[scheduler] msg", nil),
+		newEntry(logrus.InfoLevel, "msg", logrus.Fields{"prefix": "http"}),
+	}
+	column := -1
+	for _, entry := range entries {
+		got := stripANSI(format(t, f, entry))
+		if i := strings.Index(got, "msg"); column < 0 {
+			column = i
+		} else if i != column {
+			t.Errorf("got %q, want the message at column %d", got, column)
+		}
+	}
+
+	long := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", logrus.Fields{"prefix": "a-very-long-prefix"})))
+	if strings.Contains(long, "  ") {
+		t.Errorf("long prefix: got %q, want it unpadded", long)
+	}
+}
+
+func TestMergeNestedPrefixes(t *testing.T) {
+	tests := []struct {
+		separator string
+		message   string
+		prefix    string
+		rest      string
+	}{
+		{"", "[http] Request", "http", "Request"},
+		{"", "[http][auth] Request", "http/auth", "Request"},
+		{"", "[http][auth][jwt] Request", "http/auth/jwt", "Request"},
+		{" > ", "[http][auth] Request", "http > auth", "Request"},
+		{"", "[http] Request [42] done", "http", "Request [42] done"},
+		{"", "Request [42] done", "", "Request [42] done"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{MergeNestedPrefixes: true, PrefixSeparator: test.separator}
+		prefix, rest := f.extractPrefix(test.message)
+		if prefix != test.prefix || rest != test.rest {
+			t.Errorf("%q: got %q, %q, want %q, %q", test.message, prefix, rest, test.prefix, test.rest)
+		}
+	}
+
+	f := &TextFormatter{}
+	if prefix, rest := f.extractPrefix("[http][auth] Request"); prefix != "http" || rest != "[auth] Request" {
+		t.Errorf("without MergeNestedPrefixes: got %q, %q", prefix, rest)
+	}
+}
+
+func TestColorByField(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, ColorByField: "tenant"}
+	levelColor := func(level logrus.Level, data logrus.Fields) string {
+		got := format(t, f, newEntry(level, "msg", data))
+		return got[:strings.Index(got, "m")+1]
+	}
+
+	acme := levelColor(logrus.InfoLevel, logrus.Fields{"tenant": "acme"})
+	if again := levelColor(logrus.ErrorLevel, logrus.Fields{"tenant": "acme"}); again != acme {
+		t.Errorf("same tenant got %q and %q", acme, again)
+	}
+	if other := levelColor(logrus.InfoLevel, logrus.Fields{"tenant": "globex"}); other == acme {
+		t.Errorf("different tenants both got %q", acme)
+	}
+	if fallback := levelColor(logrus.WarnLevel, nil); fallback != ansi.Yellow {
+		t.Errorf("without the field: got %q, want the level color", fallback)
+	}
+}
+
+func TestFieldFormatJSON(t *testing.T) {
+	data := logrus.Fields{"quote": `say "hi"`, "newline": "a\nb", "html": "<b>&</b>", "n": 1.5, "err": errors.New("boom"), "ch": make(chan int)}
+	entry := newEntry(logrus.InfoLevel, "msg", data)
+	for _, colored := range []bool{false, true} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, DisableTimestamp: true, FieldFormat: FieldFormatJSON}
+		got := stripANSI(format(t, f, entry))
+		object := strings.TrimSuffix(got[strings.Index(got, "{"):], "\n")
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(object), &decoded); err != nil {
+			t.Fatalf("colored %v: invalid JSON %q: %v", colored, object, err)
+		}
+		if decoded["quote"] != `say "hi"` || decoded["newline"] != "a\nb" || decoded["html"] != "<b>&</b>" || decoded["n"] != 1.5 || decoded["err"] != "boom" {
+			t.Errorf("colored %v: got %v", colored, decoded)
+		}
+		if !strings.HasPrefix(object, `{"ch":`) || !strings.Contains(object, `"html":"<b>&</b>"`) {
+			t.Errorf("colored %v: got %q, want sorted keys and no HTML escaping", colored, object)
+		}
+	}
+}
+
+type multilineError struct{}
+
+func (multilineError) Error() string { return "boom" }
+
+func (multilineError) Format(s fmt.State, verb rune) {
+	fmt.Fprint(s, "boom\n\tat main.go:1")
+}
+
+func TestControlCharEscaping(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"text": "a\nb\tc\rd"})
+	for _, tt := range []struct {
+		colored, disable bool
+		want             string
+	}{
+		{false, false, `text="a\nb\tc\rd"`},
+		{false, true, `text="a\nb\tc\rd"`},
+		{true, false, `text=a\nb\tc\rd`},
+		{true, true, "text=a\nb\tc\rd"},
+	} {
+		f := &TextFormatter{ForceColors: tt.colored, DisableColors: !tt.colored, DisableTimestamp: true, DisableControlCharEscaping: tt.disable}
+		if got := stripANSI(format(t, f, entry)); !strings.Contains(got, tt.want) {
+			t.Errorf("colored %v, disabled %v: got %q, want it to contain %q", tt.colored, tt.disable, got, tt.want)
+		}
+	}
+
+	entry = newEntry(logrus.ErrorLevel, "failed", logrus.Fields{"error": multilineError{}})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, ExpandErrors: true}
+	if got := stripANSI(format(t, f, entry)); !strings.HasSuffix(got, `error=boom\n\tat main.go:1`+"\n") {
+		t.Errorf("got %q, want the stack trace escaped", got)
+	}
+	f.DisableControlCharEscaping = true
+	if got := stripANSI(format(t, f, entry)); !strings.HasSuffix(got, "error=boom\n\tat main.go:1\n") {
+		t.Errorf("got %q, want the stack trace left as is", got)
+	}
+}
+
+func TestTimestampLevels(t *testing.T) {
+	for _, colored := range []bool{false, true} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, TimestampFormat: "15:04:05", TimestampLevels: []logrus.Level{logrus.WarnLevel}}
+		warn := stripANSI(format(t, f, newEntry(logrus.WarnLevel, "msg", nil)))
+		debug := stripANSI(format(t, f, newEntry(logrus.DebugLevel, "msg", nil)))
+		if !strings.Contains(warn, "15:04:05") {
+			t.Errorf("colored %v: got %q, want a timestamp", colored, warn)
+		}
+		if strings.Contains(debug, "15:04:05") || strings.HasPrefix(debug, " ") || strings.Contains(debug, "  ") {
+			t.Errorf("colored %v: got %q, want no timestamp and no stray spaces", colored, debug)
+		}
+	}
+
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", DisableTimestamp: true, TimestampLevels: []logrus.Level{}}
+	if got := stripANSI(format(t, f, newEntry(logrus.ErrorLevel, "msg", nil))); got != "ERROR msg\n" {
+		t.Errorf("got %q, want no timestamp for an empty set", got)
+	}
+}
+
+func TestUseUTC(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", nil)
+	entry.Time = time.Date(2006, time.January, 12, 15, 4, 5, 0, time.FixedZone("UTC+2", 2*60*60))
+	for _, colored := range []bool{false, true} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, TimestampFormat: time.RFC3339, UseUTC: true}
+		if got := stripANSI(format(t, f, entry)); !strings.Contains(got, "2006-01-12T13:04:05Z") {
+			t.Errorf("colored %v: got %q, want the time in UTC", colored, got)
+		}
+	}
+}
+
+func TestTimestampMillis(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", nil)
+	entry.Time = testTime.Add(42 * time.Millisecond)
+	f := &TextFormatter{ForceColors: true, TimestampMillis: true}
+	if got := stripANSI(format(t, f, entry)); !strings.HasPrefix(got, "[Jan 12 15:04:05.042] ") {
+		t.Errorf("got %q, want milliseconds", got)
+	}
+	f.TimestampFormat = "15:04:05"
+	if got := stripANSI(format(t, f, entry)); !strings.HasPrefix(got, "[15:04:05] ") {
+		t.Errorf("got %q, want a custom format left as is", got)
+	}
+}
+
+func TestLevelLetter(t *testing.T) {
+	tests := []struct {
+		level logrus.Level
+		want  string
+		color string
+	}{
+		{logrus.DebugLevel, "D", ansi.White},
+		{logrus.InfoLevel, "I", ansi.Blue},
+		{logrus.WarnLevel, "W", ansi.Yellow},
+		{logrus.ErrorLevel, "E", ansi.Red},
+		{logrus.FatalLevel, "F", ansi.Red},
+		{logrus.PanicLevel, "P", ansi.Red},
+	}
+	// The column is one letter wide unless LevelPadding says otherwise.
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelLetter: true}
+	for _, test := range tests {
+		want := test.color + test.want + ansi.Reset + " msg\n"
+		if got := format(t, f, newEntry(test.level, "msg", nil)); got != want {
+			t.Errorf("level %v: got %q, want %q", test.level, got, want)
+		}
+	}
+
+	f.LevelPadding = 3
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != "  I msg\n" {
+		t.Errorf("LevelPadding 3: got %q", got)
+	}
+}
+
+func TestLevelIcons(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelIcons: map[logrus.Level]string{logrus.ErrorLevel: "❌"}}
+	if got := stripANSI(format(t, f, newEntry(logrus.ErrorLevel, "msg", nil))); got != "❌ ERROR msg\n" {
+		t.Errorf("got %q, want the icon in front of the level", got)
+	}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != " INFO msg\n" {
+		t.Errorf("got %q, want no icon", got)
+	}
+}
+
+func TestPrefixMessageSeparator(t *testing.T) {
+	tests := []struct {
+		separator string
+		data      logrus.Fields
+		want      string
+	}{
+		{"", nil, " INFO msg\n"},
+		{"", logrus.Fields{"prefix": "db"}, " INFO (db): msg\n"},
+		{" | ", logrus.Fields{"prefix": "db"}, " INFO (db): | msg\n"},
+		{" | ", nil, " INFO msg\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrefixMessageSeparator: test.separator}
+		if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", test.data))); got != test.want {
+			t.Errorf("separator %q: got %q, want %q", test.separator, got, test.want)
+		}
+	}
+}
+
+func TestStableUnsortedOrder(t *testing.T) {
+	data := logrus.Fields{}
+	for i := 0; i < 20; i++ {
+		data["key"+strconv.Itoa(i)] = i
+	}
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, DisableSorting: true, StableUnsortedOrder: true}
+	first := format(t, f, newEntry(logrus.InfoLevel, "msg", data))
+	for i := 0; i < 10; i++ {
+		if got := format(t, f, newEntry(logrus.InfoLevel, "msg", data)); got != first {
+			t.Fatalf("got %q, then %q", first, got)
+		}
+	}
+}
+
+func TestValueFormatter(t *testing.T) {
+	var keys []string
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, ValueFormatter: func(key string, value interface{}) interface{} {
+		keys = append(keys, key)
+		switch key {
+		case "password":
+			return "***"
+		case "duration":
+			return value.(time.Duration).Seconds()
+		}
+		return value
+	}}
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"password": "hunter2", "duration": 1500 * time.Millisecond, "prefix": "db"})
+	if got := format(t, f, entry); got != `level=info msg=msg duration=1.5 password="***" `+"\n" {
+		t.Errorf("got %q", got)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "duration,password" {
+		t.Errorf("called for %v, want just the fields", keys)
+	}
+
+	f.ForceColors, f.DisableColors = true, false
+	if got := stripANSI(format(t, f, entry)); got != " INFO (db): msg duration=1.5 password=***\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTimeFieldValues(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"at": testTime, "took": 1234567 * time.Microsecond})
+	for colored, want := range map[bool]string{false: `at="15:04:05" took=1.235s`, true: "at=15:04:05 took=1.235s"} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, DisableTimestamp: true, TimestampFormat: "15:04:05", DurationRounding: time.Millisecond}
+		if got := stripANSI(format(t, f, entry)); !strings.Contains(got, want) {
+			t.Errorf("colored %v: got %q, want it to contain %q", colored, got, want)
+		}
+	}
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, TimestampFormat: "15:04:05"}
+	if got := format(t, f, entry); !strings.Contains(got, "took=1.234567s") {
+		t.Errorf("got %q, want the duration unrounded", got)
+	}
+}
+
+func TestPadTimestamp(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "January 2", PadTimestamp: true}
+	early := newEntry(logrus.InfoLevel, "msg", nil)
+	early.Time = time.Date(2006, time.May, 1, 0, 0, 0, 0, time.Local)
+	late := newEntry(logrus.InfoLevel, "msg", nil)
+	late.Time = time.Date(2006, time.September, 10, 0, 0, 0, 0, time.Local)
+	got := []string{stripANSI(format(t, f, early)), stripANSI(format(t, f, late))}
+	want := []string{"[May 1       ]  INFO msg\n", "[September 10]  INFO msg\n"}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got[i], want[i])
+		}
+	}
+}
+
+func TestOutputTerminalDetection(t *testing.T) {
+	setColorEnv(t, nil)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	for _, output := range []io.Writer{&bytes.Buffer{}, w} {
+		f := &TextFormatter{Output: output}
+		if f.IsColored() {
+			t.Errorf("output %T: colored, want plain for a non-terminal", output)
+		}
+		if got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)); strings.Contains(got, "\x1b[") {
+			t.Errorf("output %T: got %q, want no escape sequences", output, got)
+		}
+	}
+
+	f := &TextFormatter{Output: &bytes.Buffer{}, EnableWindowsColors: true}
+	f.terminal = terminalYes
+	if !f.IsColored() && enableVirtualTerminal() {
+		t.Error("plain, want colored for a terminal")
+	}
+}
+
+func TestResetTerminal(t *testing.T) {
+	setColorEnv(t, nil)
+	f := &TextFormatter{Output: &bytes.Buffer{}}
+	if f.IsColored() {
+		t.Fatal("colored, want plain for a buffer")
+	}
+	f.terminal = terminalYes
+	if !f.isTerminal() {
+		t.Fatal("cached terminal state ignored")
+	}
+	f.ResetTerminal()
+	if f.isTerminal() {
+		t.Error("terminal after ResetTerminal, want the buffer checked again")
+	}
+}
+
+func TestTraceLevel(t *testing.T) {
+	entry := newEntry(logrus.TraceLevel, "msg", nil)
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true}
+	if got, want := format(t, f, entry), ansi.LightBlack+"TRACE"+ansi.Reset+" msg\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	f.Colors = &Colors{Trace: "cyan"}
+	if got, want := format(t, f, entry), ansi.Cyan+"TRACE"+ansi.Reset+" msg\n"; got != want {
+		t.Errorf("custom color: got %q, want %q", got, want)
+	}
+
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	if got := format(t, f, entry); got != "level=trace msg=msg \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestFatalPanicColors(t *testing.T) {
+	tests := []struct {
+		colors *Colors
+		level  logrus.Level
+		want   string
+	}{
+		{&Colors{Fatal: "red+b"}, logrus.FatalLevel, ansi.ColorCode("red+b")},
+		{&Colors{Panic: "magenta"}, logrus.PanicLevel, ansi.Magenta},
+		{&Colors{Fatal: "red+b"}, logrus.PanicLevel, ansi.Red},
+		{&Colors{Error: "yellow"}, logrus.FatalLevel, ansi.Yellow},
+		{&Colors{Error: "yellow"}, logrus.PanicLevel, ansi.Yellow},
+		{nil, logrus.FatalLevel, ansi.Red},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: test.colors}
+		label := strings.ToUpper(test.level.String())
+		if got, want := format(t, f, newEntry(test.level, "msg", nil)), test.want+label+ansi.Reset+" msg\n"; got != want {
+			t.Errorf("%+v, level %v: got %q, want %q", test.colors, test.level, got, want)
+		}
+	}
+}
+
+func TestLevelTextCase(t *testing.T) {
+	want := map[LevelTextCase][]string{
+		LevelTextUpper: {"PANIC", "FATAL", "ERROR", "WARN", "INFO", "DEBUG", "TRACE"},
+		LevelTextLower: {"panic", "fatal", "error", "warn", "info", "debug", "trace"},
+		LevelTextTitle: {"Panic", "Fatal", "Error", "Warn", "Info", "Debug", "Trace"},
+		LevelTextAsIs:  {"panic", "fatal", "error", "warning", "info", "debug", "trace"},
+	}
+	for textCase, labels := range want {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelPadding: -1, LevelTextCase: textCase}
+		for i, level := range logrus.AllLevels {
+			if got := stripANSI(format(t, f, newEntry(level, "msg", nil))); got != labels[i]+" msg\n" {
+				t.Errorf("case %d, level %v: got %q, want %q", textCase, level, got, labels[i])
+			}
+		}
+	}
+
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelTextCase: LevelTextLower, LevelNames: map[logrus.Level]string{logrus.WarnLevel: "Wrn"}}
+	if got := stripANSI(format(t, f, newEntry(logrus.WarnLevel, "msg", nil))); got != "  Wrn msg\n" {
+		t.Errorf("custom name: got %q, want it used verbatim", got)
+	}
+}
+
+func TestIsColoredMatrix(t *testing.T) {
+	setColorEnv(t, nil)
+	for _, force := range []bool{false, true} {
+		for _, disable := range []bool{false, true} {
+			for _, terminal := range []bool{false, true} {
+				f := &TextFormatter{ForceColors: force, DisableColors: disable, Output: &bytes.Buffer{}, EnableWindowsColors: true}
+				if terminal {
+					f.terminal = terminalYes
+				}
+				want := !disable && (force || terminal && enableVirtualTerminal())
+				if got := f.IsColored(); got != want {
+					t.Errorf("ForceColors %v, DisableColors %v, terminal %v: IsColored() = %v, want %v", force, disable, terminal, got, want)
+				}
+				if got := strings.Contains(format(t, f, newEntry(logrus.InfoLevel, "msg", nil)), "\x1b["); got != want {
+					t.Errorf("ForceColors %v, DisableColors %v, terminal %v: colored output %v, want %v", force, disable, terminal, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFieldSeparator(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": 2})
+	for _, separator := range []string{"  ", "\t"} {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, FieldSeparator: separator}
+		if got, want := stripANSI(format(t, f, entry)), " INFO msg"+separator+"a=1"+separator+"b=2\n"; got != want {
+			t.Errorf("colored, separator %q: got %q, want %q", separator, got, want)
+		}
+		f = &TextFormatter{DisableColors: true, DisableTimestamp: true, FieldSeparator: separator}
+		if got, want := format(t, f, entry), "level=info"+separator+"msg=msg"+separator+"a=1"+separator+"b=2"+separator+"\n"; got != want {
+			t.Errorf("plain, separator %q: got %q, want %q", separator, got, want)
+		}
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	entry := newEntry(logrus.ErrorLevel, "failed", logrus.Fields{"error": multilineError{}})
+	tests := []struct {
+		expand, colored bool
+		want            string
+	}{
+		{false, false, "error=boom \n"},
+		{true, false, `error="boom\n\tat main.go:1" ` + "\n"},
+		{false, true, "error=boom\n"},
+		{true, true, `error=boom\n\tat main.go:1` + "\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: test.colored, DisableColors: !test.colored, DisableTimestamp: true, ExpandErrors: test.expand}
+		if got := stripANSI(format(t, f, entry)); !strings.HasSuffix(got, test.want) {
+			t.Errorf("expand %v, colored %v: got %q, want it to end in %q", test.expand, test.colored, got, test.want)
+		}
+	}
+
+	wrapped := fmt.Errorf("query: %w", errors.New("connection refused"))
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, ExpandErrors: true}
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "failed", logrus.Fields{"error": wrapped})); !strings.Contains(got, `error="query: connection refused"`) {
+		t.Errorf("got %q, want the whole chain", got)
+	}
+}
+
+func TestCompactPrefix(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, CompactPrefix: true}
+	tests := []struct {
+		data logrus.Fields
+		want string
+	}{
+		{logrus.Fields{"prefix": "db"}, ansi.Red + "ERROR[db]" + ansi.Reset + " failed\n"},
+		{nil, ansi.Red + "ERROR" + ansi.Reset + " failed\n"},
+	}
+	for _, test := range tests {
+		if got := format(t, f, newEntry(logrus.ErrorLevel, "failed", test.data)); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.data, got, test.want)
+		}
+	}
+
+	f = &TextFormatter{ForceColors: true, CompactPrefix: true, TimestampFormat: "15:04:05"}
+	if got := stripANSI(format(t, f, newEntry(logrus.ErrorLevel, "[db] failed", nil))); got != "[15:04:05] ERROR[db] failed\n" {
+		t.Errorf("with timestamp: got %q", got)
+	}
+}
+
+func TestLevelLeftAlign(t *testing.T) {
+	for align, want := range map[bool]string{false: " INFO msg\n", true: "INFO  msg\n"} {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelLeftAlign: align}
+		if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != want {
+			t.Errorf("LevelLeftAlign %v: got %q, want %q", align, got, want)
+		}
+	}
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelLeftAlign: true, LevelPadding: 7}
+	if got := stripANSI(format(t, f, newEntry(logrus.WarnLevel, "msg", nil))); got != "WARN    msg\n" {
+		t.Errorf("padding 7: got %q", got)
+	}
+}
+
+func TestPrefixFieldName(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"component": "db", "prefix": "other"})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrefixFieldName: "component"}
+	if got := stripANSI(format(t, f, entry)); got != " INFO (db): msg prefix=other\n" {
+		t.Errorf("colored: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, PrefixFieldName: "component"}
+	if got := format(t, f, entry); got != "level=info msg=msg prefix=other \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestHiddenFields(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"span_context": "x", "a": 1, "b": 2})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, HiddenFields: []string{"span_context", "b"}}
+	if got := stripANSI(format(t, f, entry)); got != " INFO msg a=1\n" {
+		t.Errorf("colored: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, HiddenFields: []string{"span_context"}}
+	if got := format(t, f, entry); got != "level=info msg=msg a=1 b=2 \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestOnlyFields(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"status": 200, "request_id": "r1", "path": "/"})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, OnlyFields: []string{"status", "request_id", "missing"}, HiddenFields: []string{"status"}}
+	if got := stripANSI(format(t, f, entry)); got != " INFO msg status=200 request_id=r1\n" {
+		t.Errorf("colored: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, OnlyFields: []string{"status", "request_id"}}
+	if got := format(t, f, entry); got != "level=info msg=msg status=200 request_id=r1 \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestSkipPrefixes(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, SkipPrefixes: []string{"noisy"}}
+	for _, entry := range []*logrus.Entry{
+		newEntry(logrus.InfoLevel, "msg", logrus.Fields{"prefix": "noisy"}),
+		newEntry(logrus.InfoLevel, "[noisy] msg", nil),
+	} {
+		if got := format(t, f, entry); got != "" {
+			t.Errorf("got %q, want nothing", got)
+		}
+	}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "[db] msg", nil))); got != " INFO (db): msg\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFormatString(t *testing.T) {
+	f := &TextFormatter{ForceColors: true}
+	entry := newEntry(logrus.WarnLevel, "[db] slow", logrus.Fields{"ms": 1200})
+	serialized, err := f.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(serialized)
+	got, err := f.FormatString(entry)
+	if err != nil || got != want {
+		t.Errorf("FormatString() = %q, %v, want %q", got, err, want)
+	}
+	f.Format(newEntry(logrus.InfoLevel, "other", nil))
+	if got != want {
+		t.Errorf("string changed to %q by a later Format", got)
+	}
+}
+
+func TestPrettyFields(t *testing.T) {
+	type inner struct {
+		Port int `json:"port"`
+	}
+	value := struct {
+		Host  string `json:"host"`
+		Inner inner  `json:"inner"`
+	}{"db", inner{5432}}
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"config": value, "n": 1})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrettyFields: true}
+	want := " INFO msg n=1\n" +
+		"  config={\n" +
+		"    \"host\": \"db\",\n" +
+		"    \"inner\": {\n" +
+		"      \"port\": 5432\n" +
+		"    }\n" +
+		"  }\n"
+	if got := stripANSI(format(t, f, entry)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTimestampDelimiters(t *testing.T) {
+	tests := []struct {
+		f    TextFormatter
+		want string
+	}{
+		{TextFormatter{}, "[15:04:05]  INFO msg\n"},
+		{TextFormatter{TimestampPrefix: "(", TimestampSuffix: ")"}, "(15:04:05)  INFO msg\n"},
+		{TextFormatter{TimestampSuffix: " |"}, "15:04:05 |  INFO msg\n"},
+		{TextFormatter{DisableTimestampDelimiters: true}, "15:04:05  INFO msg\n"},
+		{TextFormatter{DisableTimestampDelimiters: true, TimestampPrefix: "("}, "15:04:05  INFO msg\n"},
+		{TextFormatter{ShortTimestamp: true, TimestampPrefix: "<", TimestampSuffix: ">"}, "<0000>  INFO msg\n"},
+	}
+	for _, test := range tests {
+		f := test.f
+		f.ForceColors, f.TimestampFormat = true, "15:04:05"
+		f.ResetTimer()
+		if got := stripANSI(format(t, &f, newEntry(logrus.InfoLevel, "msg", nil))); got != test.want {
+			t.Errorf("%q %q, disabled %v: got %q, want %q", test.f.TimestampPrefix, test.f.TimestampSuffix, test.f.DisableTimestampDelimiters, got, test.want)
+		}
+	}
+}
+
+func TestKeyValueSeparator(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1})
+	for _, separator := range []string{" = ", ":"} {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, KeyValueSeparator: separator}
+		if got, want := stripANSI(format(t, f, entry)), " INFO msg a"+separator+"1\n"; got != want {
+			t.Errorf("colored, separator %q: got %q, want %q", separator, got, want)
+		}
+		f = &TextFormatter{DisableColors: true, DisableTimestamp: true, KeyValueSeparator: separator}
+		if got, want := format(t, f, entry), "level"+separator+"info msg"+separator+"msg a"+separator+"1 \n"; got != want {
+			t.Errorf("plain, separator %q: got %q, want %q", separator, got, want)
+		}
+	}
+}
+
+func TestLevelFirst(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", LevelFirst: true}
+	tests := []struct {
+		message, want string
+	}{
+		{"msg", ansi.Red + "ERROR" + ansi.Reset + " " + ansi.LightBlack + "[15:04:05]" + ansi.Reset + " msg\n"},
+		{"[db] msg", ansi.Red + "ERROR" + ansi.Reset + " " + ansi.LightBlack + "[15:04:05]" + ansi.Reset + " " + ansi.LightBlack + "(db):" + ansi.Reset + " msg\n"},
+	}
+	for _, test := range tests {
+		if got := format(t, f, newEntry(logrus.ErrorLevel, test.message, nil)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.message, got, test.want)
+		}
+	}
+}
+
+func TestMaxFields(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, MaxFields: 2}
+	got := format(t, f, entry)
+	if !strings.HasSuffix(got, " "+ansi.LightBlack+"(+3 more)"+ansi.Reset+"\n") {
+		t.Errorf("got %q, want a colored (+3 more) marker", got)
+	}
+	if plain := stripANSI(got); plain != " INFO msg a=1 b=2 (+3 more)\n" {
+		t.Errorf("got %q", plain)
+	}
+	f.MaxFields = 5
+	if got := stripANSI(format(t, f, entry)); strings.Contains(got, "more") {
+		t.Errorf("got %q, want no marker when all fields fit", got)
+	}
+}
+
+type celsius float64
+
+func (c celsius) String() string { return fmt.Sprintf("%.1f °C", float64(c)) }
+
+func TestStringerValues(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"temp": celsius(21.5), "nil": (*celsius)(nil)})
+	plain := format(t, &TextFormatter{DisableColors: true, DisableTimestamp: true}, entry)
+	colored := stripANSI(format(t, &TextFormatter{ForceColors: true, DisableTimestamp: true, ForceQuote: true}, entry))
+	for _, got := range []string{plain, colored} {
+		if !strings.Contains(got, `temp="21.5 °C"`) || !strings.Contains(got, "nil=<nil>") {
+			t.Errorf("got %q, want the String() of the value, quoted", got)
+		}
+	}
+}
+
+func TestTruncateLevelText(t *testing.T) {
+	names := map[logrus.Level]string{logrus.WarnLevel: "WARNING"}
+	tests := []struct {
+		truncate bool
+		padding  int
+		want     string
+	}{
+		{false, 0, "WARNING msg\n"},
+		{true, 0, "WARNI msg\n"},
+		{true, 3, "WAR msg\n"},
+		{true, -1, "WARNING msg\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelNames: names, TruncateLevelText: test.truncate, LevelPadding: test.padding}
+		if got := stripANSI(format(t, f, newEntry(logrus.WarnLevel, "msg", nil))); got != test.want {
+			t.Errorf("truncate %v, padding %d: got %q, want %q", test.truncate, test.padding, got, test.want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	f := &TextFormatter{
+		ForceColors:  true,
+		Colors:       &Colors{Info: "blue"},
+		LevelNames:   map[logrus.Level]string{logrus.InfoLevel: "INF"},
+		HiddenFields: []string{"secret"},
+		PrefixColors: map[string]string{"db": "cyan"},
+		FieldLevels:  map[string][]logrus.Level{"trace_id": {logrus.DebugLevel}},
+	}
+	clone := f.Clone()
+	clone.DisableColors = true
+	clone.Colors.Info = "red"
+	clone.LevelNames[logrus.InfoLevel] = "I"
+	clone.HiddenFields[0] = "other"
+	clone.PrefixColors["db"] = "green"
+	clone.FieldLevels["trace_id"][0] = logrus.InfoLevel
+
+	if f.DisableColors || f.Colors.Info != "blue" || f.LevelNames[logrus.InfoLevel] != "INF" || f.HiddenFields[0] != "secret" ||
+		f.PrefixColors["db"] != "cyan" || f.FieldLevels["trace_id"][0] != logrus.DebugLevel {
+		t.Errorf("original changed through the clone: %+v", f)
+	}
+}
+
+func TestRightAlignFieldsOutputWidth(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1})
+	for _, output := range []io.Writer{&bytes.Buffer{}, w} {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, RightAlignFields: true, Output: output}
+		if width := f.terminalWidth(); width != 0 {
+			t.Errorf("output %T: terminal width %d, want 0 for a non-terminal", output, width)
+		}
+		if got := stripANSI(format(t, f, entry)); got != " INFO msg a=1\n" {
+			t.Errorf("output %T: got %q, want the fields left where they are", output, got)
+		}
+		f.MaxLineWidth = 20
+		if got := stripANSI(format(t, f, entry)); got != " INFO msg        a=1\n" {
+			t.Errorf("output %T, MaxLineWidth 20: got %q", output, got)
+		}
+	}
+}
+
+func TestColorFieldName(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  logrus.Fields
+		color string
+	}{
+		{"", logrus.Fields{"_color": "magenta", "a": 1}, ansi.Magenta},
+		{"", logrus.Fields{"_color": "no-such-color", "a": 1}, ansi.Blue},
+		{"", logrus.Fields{"_color": "", "a": 1}, ansi.Blue},
+		{"tint", logrus.Fields{"tint": "magenta", "a": 1}, ansi.Magenta},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, ColorFieldName: test.name}
+		want := test.color + " INFO" + ansi.Reset + " msg " + test.color + "a" + ansi.Reset + "=1\n"
+		if got := format(t, f, newEntry(logrus.InfoLevel, "msg", test.data)); got != want {
+			t.Errorf("%v: got %q, want %q", test.data, got, want)
+		}
+	}
+}
+
+func TestFieldsOnNewLine(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": 2})
+	for indent, want := range map[string]string{"": " INFO msg\n  a=1 b=2\n", "\t": " INFO msg\n\ta=1 b=2\n"} {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, FieldsOnNewLine: true, FieldIndent: indent}
+		if got := stripANSI(format(t, f, entry)); got != want {
+			t.Errorf("indent %q: got %q, want %q", indent, got, want)
+		}
+	}
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, FieldsOnNewLine: true}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != " INFO msg\n" {
+		t.Errorf("without fields: got %q", got)
+	}
+}
+
+func TestPrefixColors(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: &Colors{Prefix: "yellow"}, PrefixColors: map[string]string{"db": "cyan", "http": "green"}}
+	for prefix, color := range map[string]string{"db": ansi.Cyan, "http": ansi.Green, "auth": ansi.Yellow} {
+		want := ansi.Blue + " INFO" + ansi.Reset + " " + color + "(" + prefix + "):" + ansi.Reset + " msg\n"
+		if got := format(t, f, newEntry(logrus.InfoLevel, "["+prefix+"] msg", nil)); got != want {
+			t.Errorf("prefix %s: got %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func BenchmarkFormatManyFields(b *testing.B) {
+	f := &TextFormatter{ForceColors: true}
+	data := logrus.Fields{}
+	for i := 0; i < 12; i++ {
+		data["key"+strconv.Itoa(i)] = i
+	}
+	entry := newEntry(logrus.InfoLevel, "Started observing beach", data)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f.Format(entry)
+	}
+}
+
+func TestAlwaysStripMessagePrefix(t *testing.T) {
+	tests := []struct {
+		strip   bool
+		message string
+		data    logrus.Fields
+		want    string
+	}{
+		{false, "[http] msg", logrus.Fields{"prefix": "db"}, " INFO (db): [http] msg\n"},
+		{true, "[http] msg", logrus.Fields{"prefix": "db"}, " INFO (db): msg\n"},
+		{true, "msg", logrus.Fields{"prefix": "db"}, " INFO (db): msg\n"},
+		{true, "[http] msg", nil, " INFO (http): msg\n"},
+		{false, "[http] msg", nil, " INFO (http): msg\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, AlwaysStripMessagePrefix: test.strip}
+		if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, test.message, test.data))); got != test.want {
+			t.Errorf("strip %v, %q, %v: got %q, want %q", test.strip, test.message, test.data, got, test.want)
+		}
+	}
+}
+
+func TestShowPIDAndHostname(t *testing.T) {
+	defer func(lookup func() (string, error)) {
+		osHostname, hostnameOnce, hostname = lookup, sync.Once{}, ""
+	}(osHostname)
+	osHostname, hostnameOnce, hostname = func() (string, error) { return "beach", nil }, sync.Once{}, ""
+
+	pid := strconv.Itoa(os.Getpid())
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, ShowPID: true, ShowHostname: true}
+	if got, want := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)), "level=info msg=msg host=beach pid="+pid+" \n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := format(t, f, newEntry(logrus.InfoLevel, "msg", logrus.Fields{"host": "other"})); !strings.Contains(got, "host=other ") {
+		t.Errorf("got %q, want the field of the entry kept", got)
+	}
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, ShowHostname: true}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != " INFO msg host=beach\n" {
+		t.Errorf("colored: got %q", got)
+	}
+	f.ShowHostname = false
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != " INFO msg\n" {
+		t.Errorf("disabled: got %q", got)
+	}
+}
+
+func TestTimestampColor(t *testing.T) {
+	tests := []struct {
+		colors *Colors
+		want   string
+	}{
+		{&Colors{Prefix: "yellow", Timestamp: "cyan"}, ansi.Cyan},
+		{&Colors{Prefix: "yellow"}, ansi.Yellow},
+		{nil, ansi.LightBlack},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", Colors: test.colors}
+		if got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)); !strings.HasPrefix(got, test.want+"[15:04:05]"+ansi.Reset) {
+			t.Errorf("%+v: got %q, want the timestamp in %q", test.colors, got, test.want)
+		}
+	}
+}
+
+func TestNilData(t *testing.T) {
+	entry := &logrus.Entry{Time: testTime, Level: logrus.InfoLevel, Message: "msg"}
+	tests := []struct {
+		f    *TextFormatter
+		want string
+	}{
+		{&TextFormatter{DisableColors: true, DisableTimestamp: true}, "level=info msg=msg \n"},
+		{&TextFormatter{ForceColors: true, DisableTimestamp: true}, " INFO msg\n"},
+		{&TextFormatter{DisableColors: true, DisableTimestamp: true, FieldFormat: FieldFormatJSON, FullJSONFallback: true}, `{"level":"info","msg":"msg"}` + "\n"},
+	}
+	for _, test := range tests {
+		if got := stripANSI(format(t, test.f, entry)); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestRenderParts(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", HiddenFields: []string{"secret"}}
+	entry := newEntry(logrus.WarnLevel, "[db] Slow query", logrus.Fields{"ms": 1200, "table": "users", "secret": "x", "_color": "red"})
+	timestamp, level, prefix, message, fields := f.renderParts(entry, nil)
+	if timestamp != "15:04:05" || level != "WARN" || prefix != "db" || message != "Slow query" {
+		t.Errorf("got %q %q %q %q", timestamp, level, prefix, message)
+	}
+	if want := []field{{"ms", 1200}, {"table", "users"}}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+
+	f = &TextFormatter{MinimalMode: true}
+	timestamp, level, prefix, message, fields = f.renderParts(newEntry(logrus.InfoLevel, "msg", logrus.Fields{"prefix": "main"}), make([]field, 0, 4))
+	if timestamp != "" || level != "" || prefix != "main" || message != "msg" || len(fields) != 0 {
+		t.Errorf("minimal: got %q %q %q %q %v", timestamp, level, prefix, message, fields)
+	}
+}
+
+func TestEqualsColor(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: &Colors{Equals: "green"}}
+	if got, want := format(t, f, entry), " msg "+ansi.Blue+"a"+ansi.Reset+ansi.Green+"="+ansi.Reset+"1\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want it to end in %q", got, want)
+	}
+	f.Colors.FieldValue = "cyan"
+	if got, want := format(t, f, entry), ansi.Green+"="+ansi.Reset+ansi.Cyan+"1"+ansi.Reset+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("with FieldValue: got %q, want it to end in %q", got, want)
+	}
+	f.Colors = nil
+	if got := format(t, f, entry); !strings.HasSuffix(got, ansi.Reset+"=1\n") {
+		t.Errorf("default: got %q, want a plain =", got)
+	}
+}
+
+func TestSeparatorBeforeLevel(t *testing.T) {
+	for _, colored := range []bool{false, true} {
+		f := &TextFormatter{ForceColors: colored, DisableColors: !colored, DisableTimestamp: true, SeparatorBeforeLevel: map[logrus.Level]string{logrus.ErrorLevel: "-----"}}
+		if got := stripANSI(format(t, f, newEntry(logrus.ErrorLevel, "msg", nil))); !strings.HasPrefix(got, "-----\n") || strings.Count(got, "\n") != 2 {
+			t.Errorf("colored %v: got %q, want the separator on a line of its own", colored, got)
+		}
+		if got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)); strings.Contains(got, "-----") {
+			t.Errorf("colored %v: got %q, want no separator", colored, got)
+		}
+	}
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	tests := []struct {
+		message, ellipsis, want, plain string
+	}{
+		{"Hello, world", "", "Hello…", `"Hello…"`},
+		{"Hello", "", "Hello", "Hello"},
+		{"Hello, world", "...", "Hello...", "Hello..."},
+		{"日本語のメッセージ", "", "日本語のメ…", `"日本語のメ…"`},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, MaxMessageLength: 5, MessageEllipsis: test.ellipsis}
+		if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, test.message, nil))); got != " INFO "+test.want+"\n" {
+			t.Errorf("colored %q: got %q, want %q", test.message, got, test.want)
+		}
+		f = &TextFormatter{DisableColors: true, DisableTimestamp: true, MaxMessageLength: 5, MessageEllipsis: test.ellipsis}
+		if got := format(t, f, newEntry(logrus.InfoLevel, test.message, nil)); got != "level=info msg="+test.plain+" \n" {
+			t.Errorf("plain %q: got %q, want %q", test.message, got, test.plain)
+		}
+	}
+}
+
+func TestLevelBackground(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, LevelBackground: true}
+	want := ansi.Red + "\x1b[7m" + "ERROR" + ansi.Reset + " " + ansi.LightBlack + "(db):" + ansi.Reset + " msg\n"
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "[db] msg", nil)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	f.LevelBackground = false
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "msg", nil)); strings.Contains(got, "\x1b[7m") {
+		t.Errorf("got %q, want no background", got)
+	}
+}
+
+func TestColorForString(t *testing.T) {
+	palette := []string{ansi.Red, ansi.Green, ansi.Yellow, ansi.Blue, ansi.Magenta, ansi.Cyan}
+	// FNV-1a is fixed, so the assignment mustn't change between runs.
+	if got := ColorForString("walrus", palette); got != palette[fnv32a("walrus")%uint32(len(palette))] {
+		t.Errorf("got %q, want the FNV-1a pick", got)
+	}
+	if ColorForString("x", nil) != "" {
+		t.Error("want an empty string for an empty palette")
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 600; i++ {
+		counts[ColorForString("key"+strconv.Itoa(i), palette)]++
+	}
+	for _, color := range palette {
+		if counts[color] < 50 || counts[color] > 150 {
+			t.Errorf("color %q picked %d times out of 600", color, counts[color])
+		}
+	}
+}
+
+func fnv32a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"INFO", 4},
+		{ansi.Red + "ERROR" + ansi.Reset, 5},
+		{"日本", 4},
+		{"🐛 debug", 8},
+		{"⚠️", 2},
+		{"⚠", 1},
+		{"❌ ✅", 5},
+		{"🚀🪐", 4},
+		{"☺", 1},
+		{"e\u0301", 1},
+		{"\x1b]8;;file:///a\x1b\\a.go\x1b]8;;\x1b\\", 4},
+	}
+	for _, test := range tests {
+		if got := displayWidth(test.text); got != test.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", test.text, got, test.want)
+		}
+	}
+
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PrefixPadding: 8}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "[日本] msg", nil))); got != " INFO (日本):  msg\n" {
+		t.Errorf("got %q, want the wide prefix padded to 8 columns", got)
+	}
+}
+
+func TestPriorityKeys(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"b": 1, "request_id": "r1", "a": 2, "error": "e", "c": 3})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, PriorityKeys: []string{"error", "request_id", "missing"}}
+	if got := stripANSI(format(t, f, entry)); got != " INFO msg error=e request_id=r1 a=2 b=1 c=3\n" {
+		t.Errorf("colored: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, PriorityKeys: []string{"request_id"}}
+	if got := format(t, f, entry); got != "level=info msg=msg request_id=r1 a=2 b=1 c=3 error=e \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestString(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, LevelPadding: 7, SortFunc: sort.Strings}
+	got := f.String()
+	for _, want := range []string{
+		"  ForceColors: true\n",
+		"  LevelPadding: 7\n",
+		"  TimestampFormat: \"Jan _2 15:04:05\"\n",
+		"  FieldSeparator: \" \"\n",
+		"  TimestampPrefix: \"[\"\n",
+		"  ShortTimestampPadding: 4\n",
+		"  SortFunc: set=true\n",
+		"  ValueFormatter: set=false\n",
+		"  colored: true\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("String() is missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestResetCode(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", ResetCode: "\x1b[39m"}
+	got := format(t, f, newEntry(logrus.InfoLevel, "[db] msg", logrus.Fields{"a": 1}))
+	if strings.Contains(got, ansi.Reset) {
+		t.Errorf("got %q, want no ansi.Reset", got)
+	}
+	if n := strings.Count(got, "\x1b[39m"); n != 4 {
+		t.Errorf("got %q, want the custom reset after the timestamp, level, prefix and key", got)
+	}
+}
+
+func TestWrapMessage(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "[db] the quick brown fox jumps over the lazy dog", logrus.Fields{"a": 1})
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, WrapMessage: true, MaxLineWidth: 28}
+	want := " INFO (db): the quick brown\n" +
+		"            fox jumps over\n" +
+		"            the lazy dog a=1\n"
+	if got := stripANSI(format(t, f, entry)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without a terminal behind Output there's no width to wrap at.
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, WrapMessage: true, Output: &bytes.Buffer{}}
+	if got := stripANSI(format(t, f, entry)); got != " INFO (db): the quick brown fox jumps over the lazy dog a=1\n" {
+		t.Errorf("non-terminal output: got %q", got)
+	}
+}
+
+func TestShowBothTimestamps(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, TimestampFormat: "15:04:05", ShowBothTimestamps: true}
+	f.ResetTimer()
+	got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil))
+	want := ansi.LightBlack + "[15:04:05]" + ansi.Reset + ansi.LightBlack + "[+0000]" + ansi.Reset + " " + ansi.Blue + " INFO"
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want it to start with %q", got, want)
+	}
+	f.ShortTimestamp = true
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); !strings.HasPrefix(got, "[15:04:05][+0000] ") {
+		t.Errorf("with ShortTimestamp: got %q", got)
+	}
+}
+
+func TestAlwaysQuoteFields(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"detail": "ok", "other": "ok", "spaced": "a b", "n": 1, "err": errors.New("boom")})
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, AlwaysQuoteFields: []string{"detail", "n", "err"}}
+	if got := format(t, f, entry); got != `level=info msg=msg detail="ok" err="boom" n=1 other=ok spaced="a b" `+"\n" {
+		t.Errorf("plain: got %q", got)
+	}
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, AlwaysQuoteFields: []string{"detail", "err"}}
+	if got := stripANSI(format(t, f, entry)); got != ` INFO msg detail="ok" err="boom" n=1 other=ok spaced=a b`+"\n" {
+		t.Errorf("colored: got %q", got)
+	}
+}
+
+func TestByteSliceValues(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"text": []byte("hi there"), "binary": []byte{0xff, 0x00, 0x10}})
+	tests := []struct {
+		hex, colored bool
+		want         string
+	}{
+		{false, false, `binary=ff0010 text="hi there" `},
+		{true, false, "binary=ff0010 text=6869207468657265 "},
+		{false, true, "binary=ff0010 text=hi there\n"},
+		{true, true, "binary=ff0010 text=6869207468657265\n"},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: test.colored, DisableColors: !test.colored, DisableTimestamp: true, BytesAsHex: test.hex}
+		if got := stripANSI(format(t, f, entry)); !strings.Contains(got, test.want) {
+			t.Errorf("hex %v, colored %v: got %q, want it to contain %q", test.hex, test.colored, got, test.want)
+		}
+	}
+}
+
+func TestBellOnLevels(t *testing.T) {
+	setColorEnv(t, nil)
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, BellOnLevels: []logrus.Level{logrus.ErrorLevel}}
+	f.terminal = terminalYes
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "msg", nil)); !strings.HasSuffix(got, "\n\a") {
+		t.Errorf("got %q, want a bell", got)
+	}
+	if got := format(t, f, newEntry(logrus.InfoLevel, "msg", nil)); strings.Contains(got, "\a") {
+		t.Errorf("info: got %q, want no bell", got)
+	}
+
+	f.terminal = terminalNo
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "msg", nil)); strings.Contains(got, "\a") {
+		t.Errorf("no terminal: got %q, want no bell", got)
+	}
+	f.terminal, f.DisableColors = terminalYes, true
+	if got := format(t, f, newEntry(logrus.ErrorLevel, "msg", nil)); strings.Contains(got, "\a") {
+		t.Errorf("colors disabled: got %q, want no bell", got)
+	}
+}
+
+func TestMinimalMode(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, MinimalMode: true}
+	tests := []struct {
+		message string
+		data    logrus.Fields
+		want    string
+	}{
+		{"[db] Connected", logrus.Fields{"a": 1}, "(db): Connected a=1\n"},
+		{"Connected", nil, "Connected\n"},
+	}
+	for _, test := range tests {
+		got := format(t, f, newEntry(logrus.WarnLevel, test.message, test.data))
+		if stripANSI(got) != test.want {
+			t.Errorf("%q: got %q, want %q", test.message, stripANSI(got), test.want)
+		}
+		if !strings.Contains(got, ansi.Yellow+"Connected"+ansi.Reset) {
+			t.Errorf("%q: got %q, want the message in the level color", test.message, got)
+		}
+	}
+	f = &TextFormatter{DisableColors: true, MinimalMode: true}
+	if got := format(t, f, newEntry(logrus.WarnLevel, "Connected", nil)); got != "msg=Connected \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestFieldLevels(t *testing.T) {
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true, FieldLevels: map[string][]logrus.Level{"sql": {logrus.DebugLevel, logrus.TraceLevel}}}
+	data := logrus.Fields{"sql": "SELECT 1", "ms": 3}
+	if got := stripANSI(format(t, f, newEntry(logrus.DebugLevel, "query", data))); got != "DEBUG query ms=3 sql=SELECT 1\n" {
+		t.Errorf("debug: got %q", got)
+	}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "query", data))); got != " INFO query ms=3\n" {
+		t.Errorf("info: got %q", got)
+	}
+	f = &TextFormatter{DisableColors: true, DisableTimestamp: true, FieldLevels: f.FieldLevels}
+	if got := format(t, f, newEntry(logrus.InfoLevel, "query", data)); got != "level=info msg=query ms=3 \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestFormatterValue(t *testing.T) {
+	var _ logrus.Formatter = TextFormatter{ForceColors: true}.Formatter()
+	logger := logrus.New()
+	var b bytes.Buffer
+	logger.Out = &b
+	logger.Formatter = TextFormatter{DisableColors: true, DisableTimestamp: true}.Formatter()
+	logger.Info("hello")
+	if b.String() != "level=info msg=hello \n" {
+		t.Errorf("got %q", b.String())
+	}
+}
+
+func TestUnknownLevel(t *testing.T) {
+	entry := newEntry(logrus.Level(42), "msg", nil)
+	tests := []struct {
+		colors *Colors
+		color  string
+	}{
+		{nil, ansi.White},
+		{&Colors{Default: "cyan"}, ansi.Cyan},
+		{&Colors{Default: "cyan", Unknown: "magenta"}, ansi.Magenta},
+	}
+	for _, test := range tests {
+		f := &TextFormatter{ForceColors: true, DisableTimestamp: true, Colors: test.colors}
+		if got, want := format(t, f, entry), test.color+"   42"+ansi.Reset+" msg\n"; got != want {
+			t.Errorf("%+v: got %q, want %q", test.colors, got, want)
+		}
+	}
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	if got := format(t, f, entry); got != "level=42 msg=msg \n" {
+		t.Errorf("plain: got %q", got)
+	}
+}
+
+func TestPrefixSuffix(t *testing.T) {
+	tests := []struct {
+		f    TextFormatter
+		want string
+	}{
+		{TextFormatter{}, " INFO (db): msg\n"},
+		{TextFormatter{PrefixSuffix: " >"}, " INFO (db) > msg\n"},
+		{TextFormatter{DisablePrefixSuffix: true}, " INFO (db) msg\n"},
+		{TextFormatter{DisablePrefixSuffix: true, PrefixSuffix: " >"}, " INFO (db) msg\n"},
+	}
+	for _, test := range tests {
+		f := test.f
+		f.ForceColors, f.DisableTimestamp = true, true
+		if got := stripANSI(format(t, &f, newEntry(logrus.InfoLevel, "[db] msg", nil))); got != test.want {
+			t.Errorf("%q, disabled %v: got %q, want %q", test.f.PrefixSuffix, test.f.DisablePrefixSuffix, got, test.want)
+		}
+	}
+	f := &TextFormatter{ForceColors: true, DisableTimestamp: true}
+	if got := stripANSI(format(t, f, newEntry(logrus.InfoLevel, "msg", nil))); got != " INFO msg\n" {
+		t.Errorf("without prefix: got %q, want no suffix", got)
+	}
+}
+
+func TestLinePrefix(t *testing.T) {
+	entry := newEntry(logrus.InfoLevel, "msg", logrus.Fields{"a": 1, "b": "two words"})
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, LinePrefix: "> "}
+	if got := format(t, f, entry); got != `> level=info msg=msg a=1 b="two words" `+"\n" {
+		t.Errorf("plain: got %q", got)
+	}
+	f = &TextFormatter{ForceColors: true, DisableTimestamp: true, LinePrefix: "  ", FieldsOnNewLine: true}
+	got := format(t, f, entry)
+	if !strings.HasPrefix(got, "  "+ansi.Blue) {
+		t.Errorf("colored: got %q, want the line prefix uncolored in front", got)
+	}
+	if plain := stripANSI(got); plain != "   INFO msg\n    a=1 b=two words\n" {
+		t.Errorf("colored: got %q, want every line prefixed", plain)
+	}
+
+	// The line prefix counts against the width of the line.
+	tests := []struct {
+		name    string
+		f       *TextFormatter
+		message string
+		want    string
+	}{
+		{"MaxLineWidth", &TextFormatter{MaxLineWidth: 28}, "msg", "[app]:   INFO msg a=1 b=2 …\n"},
+		{"RightAlignFields", &TextFormatter{MaxLineWidth: 30, RightAlignFields: true}, "msg", "[app]:   INFO msg  a=1 b=2 c=3\n"},
+		{"WrapMessage", &TextFormatter{MaxLineWidth: 22, WrapMessage: true}, "one two three", "[app]:   INFO one two\n[app]:        three …\n"},
+	}
+	for _, test := range tests {
+		test.f.ForceColors, test.f.DisableTimestamp, test.f.LinePrefix = true, true, "[app]:  "
+		got := stripANSI(format(t, test.f, newEntry(logrus.InfoLevel, test.message, logrus.Fields{"a": 1, "b": 2, "c": 3})))
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+			if displayWidth(line) > test.f.MaxLineWidth {
+				t.Errorf("%s: line %q is wider than %d columns", test.name, line, test.f.MaxLineWidth)
+			}
+		}
+	}
+}
+
+func TestFullJSONFallback(t *testing.T) {
+	entry := newEntry(logrus.WarnLevel, `[db] query "users" failed`+"\n\tretrying", logrus.Fields{"sql": `SELECT "a" FROM <t>`, "time": "user time", "err": errors.New("boom")})
+	f := &TextFormatter{ForceColors: true, TimestampFormat: time.RFC3339, FieldFormat: FieldFormatJSON, FullJSONFallback: true, LevelNames: map[logrus.Level]string{logrus.WarnLevel: "WRN"}}
+	got := format(t, f, entry)
+	if strings.Contains(got, "\x1b[") || strings.Count(got, "\n") != 1 {
+		t.Fatalf("got %q, want a single uncolored line", got)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	want := map[string]interface{}{
+		"time":        testTime.Format(time.RFC3339),
+		"level":       "WRN",
+		"msg":         `query "users" failed` + "\n\tretrying",
+		"prefix":      "db",
+		"sql":         `SELECT "a" FROM <t>`,
+		"fields.time": "user time",
+		"err":         "boom",
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("got %v, want %v", decoded, want)
+	}
+	if !strings.HasPrefix(got, `{"time":`) || !strings.Contains(got, `"sql":"SELECT \"a\" FROM <t>"`) {
+		t.Errorf("got %q, want the entry keys first and no HTML escaping", got)
+	}
+
+	f.LevelNames = nil
+	if got := format(t, f, entry); !strings.Contains(got, `"level":"warning"`) {
+		t.Errorf("got %q, want the level name", got)
+	}
+
+	// Fields named like the prefix and caller keys are renamed too.
+	entry = newEntry(logrus.InfoLevel, "msg", logrus.Fields{"component": "db", "prefix": "p", "caller": "c", "fields.caller": "fc"})
+	f = &TextFormatter{DisableTimestamp: true, FieldFormat: FieldFormatJSON, FullJSONFallback: true, PrefixFieldName: "component", ReportCaller: true}
+	got = format(t, f, entry)
+	decoded = nil
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	for k, v := range map[string]interface{}{"prefix": "db", "fields.prefix": "p", "fields.caller": "c", "fields.fields.caller": "fc"} {
+		if decoded[k] != v {
+			t.Errorf("got %q, want %s=%v", got, k, v)
+		}
+	}
+	if decoded["caller"] == nil || strings.Count(got, `"prefix":`) != 1 || strings.Count(got, `"caller":`) != 1 {
+		t.Errorf("got %q, want a single prefix and caller key each", got)
+	}
+}
@@ -0,0 +1,110 @@
+package prefixed
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Parse reads a line of the plain, uncolored output of a TextFormatter with the
+// default timestamp format back into an entry. Field values come back as
+// strings, and a prefix at the start of the message is moved to the "prefix"
+// field, the same way the colored output shows it.
+func Parse(line string) (*logrus.Entry, error) {
+	return (&TextFormatter{}).Parse(line)
+}
+
+// Parse reads a line of the plain, uncolored output of f back into an entry,
+// like the package-level Parse does, using the timestamp format and the
+// LevelNames of f.
+func (f *TextFormatter) Parse(line string) (*logrus.Entry, error) {
+	entry := &logrus.Entry{Data: logrus.Fields{}}
+
+	line = strings.TrimRight(line, "\r\n")
+	for strings.TrimSpace(line) != "" {
+		key, value, rest, err := nextKeyValue(line)
+		if err != nil {
+			return nil, err
+		}
+		line = rest
+
+		switch key {
+		case "time":
+			if entry.Time, err = time.Parse(f.timestampLayout(), strings.TrimRight(value, " ")); err != nil {
+				return nil, fmt.Errorf("invalid time %q: %v", value, err)
+			}
+		case "level":
+			if entry.Level, err = f.parseLevel(value); err != nil {
+				return nil, err
+			}
+		case "msg":
+			entry.Message = value
+		default:
+			entry.Data[unprefixFieldClash(key)] = value
+		}
+	}
+
+	if prefix, message := f.extractPrefix(entry.Message); prefix != "" {
+		entry.Data["prefix"], entry.Message = prefix, message
+	}
+	return entry, nil
+}
+
+// parseLevel turns the level text of the plain output back into a level,
+// looking it up in LevelNames first. Levels logrus doesn't know are written as
+// their number.
+func (f *TextFormatter) parseLevel(text string) (logrus.Level, error) {
+	for level, name := range f.LevelNames {
+		if name == text {
+			return level, nil
+		}
+	}
+	if n, err := strconv.ParseUint(text, 10, 32); err == nil {
+		return logrus.Level(n), nil
+	}
+	return logrus.ParseLevel(text)
+}
+
+// unprefixFieldClash reverses prefixFieldClashes, turning "fields.time" back
+// into "time" and "fields.fields.time" into "fields.time".
+func unprefixFieldClash(key string) string {
+	if base := trimFieldsPrefix(key); base != key && isFieldClash(base) {
+		return strings.TrimPrefix(key, "fields.")
+	}
+	return key
+}
+
+// nextKeyValue splits the first key=value pair off line, unquoting the value
+// if needed.
+func nextKeyValue(line string) (key, value, rest string, err error) {
+	line = strings.TrimLeft(line, " ")
+	eq := strings.IndexByte(line, '=')
+	if space := strings.IndexByte(line, ' '); eq < 0 || (space >= 0 && space < eq) {
+		if space < 0 {
+			space = len(line)
+		}
+		return "", "", "", fmt.Errorf("missing = after %q", line[:space])
+	}
+	if eq == 0 {
+		return "", "", "", fmt.Errorf("missing key in %q", line)
+	}
+	key, line = line[:eq], line[eq+1:]
+
+	if strings.HasPrefix(line, `"`) {
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return "", "", "", fmt.Errorf("invalid quoted value for %s: %v", key, err)
+		}
+		value, _ = strconv.Unquote(quoted)
+		return key, value, line[len(quoted):], nil
+	}
+
+	end := strings.IndexByte(line, ' ')
+	if end < 0 {
+		end = len(line)
+	}
+	return key, line[:end], line[end:], nil
+}
@@ -0,0 +1,87 @@
+package prefixed
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		f    *TextFormatter
+		time time.Time
+	}{
+		{&TextFormatter{DisableColors: true}, time.Date(0, time.January, 12, 15, 4, 5, 0, time.UTC)},
+		{&TextFormatter{DisableColors: true, TimestampFormat: time.RFC3339}, time.Date(2006, time.January, 12, 15, 4, 5, 0, time.UTC)},
+		{&TextFormatter{DisableColors: true, TimestampFormat: "January 2 15:04", PadTimestamp: true}, time.Date(0, time.May, 1, 15, 4, 0, 0, time.UTC)},
+	}
+	data := logrus.Fields{"a": "1", "text": "two words", "time": "t", "fields.time": "ft", "fields.fields.msg": "ffm"}
+	for _, test := range tests {
+		entry := newEntry(logrus.WarnLevel, "[db] Connected", data)
+		entry.Time = test.time
+		line := format(t, test.f, entry)
+		parsed, err := test.f.Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned an error: %v", line, err)
+		}
+		if !parsed.Time.Equal(test.time) || parsed.Level != logrus.WarnLevel || parsed.Message != "Connected" {
+			t.Errorf("Parse(%q) = %v %v %q", line, parsed.Time, parsed.Level, parsed.Message)
+		}
+		want := logrus.Fields{"prefix": "db"}
+		for k, v := range data {
+			want[k] = v
+		}
+		if !reflect.DeepEqual(parsed.Data, want) {
+			t.Errorf("Parse(%q).Data = %v, want %v", line, parsed.Data, want)
+		}
+	}
+
+	if _, err := Parse(format(t, &TextFormatter{DisableColors: true, TimestampFormat: time.RFC3339}, newEntry(logrus.InfoLevel, "msg", nil))); err == nil {
+		t.Error("Parse() accepted a timestamp format other than the default")
+	}
+}
+
+func TestParseLevelNames(t *testing.T) {
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true, LevelNames: map[logrus.Level]string{logrus.WarnLevel: "WRN"}}
+	for _, level := range []logrus.Level{logrus.WarnLevel, logrus.InfoLevel} {
+		line := format(t, f, newEntry(level, "msg", nil))
+		parsed, err := f.Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned an error: %v", line, err)
+		}
+		if parsed.Level != level {
+			t.Errorf("Parse(%q).Level = %v, want %v", line, parsed.Level, level)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"k", `missing = after "k"`},
+		{"level=info k msg=hi", `missing = after "k"`},
+		{"=v", `missing key in "=v"`},
+		{`msg="unterminated`, "invalid quoted value for msg: invalid syntax"},
+		{"level=loud", `not a valid logrus Level: "loud"`},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.line); err == nil || err.Error() != test.want {
+			t.Errorf("Parse(%q) returned error %v, want %q", test.line, err, test.want)
+		}
+	}
+}
+
+func TestParseUnknownLevel(t *testing.T) {
+	f := &TextFormatter{DisableColors: true, DisableTimestamp: true}
+	line := format(t, f, newEntry(logrus.Level(42), "msg", nil))
+	parsed, err := f.Parse(line)
+	if err != nil {
+		t.Fatalf("Parse(%q) returned an error: %v", line, err)
+	}
+	if parsed.Level != logrus.Level(42) {
+		t.Errorf("Parse(%q).Level = %v, want 42", line, parsed.Level)
+	}
+}
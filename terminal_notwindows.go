@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package prefixed
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// isTerminalFd reports whether fd refers to a terminal.
+func isTerminalFd(fd uintptr) bool {
+	var ws winsize
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	return err == 0
+}
+
+// terminalWidthFd returns the width of the terminal fd refers to, or zero when
+// it can't be determined.
+func terminalWidthFd(fd uintptr) int {
+	var ws winsize
+	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if err != 0 {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+// enableVirtualTerminal is a no-op outside of Windows, terminals interpret ANSI
+// escape sequences as they are.
+func enableVirtualTerminal() bool {
+	return true
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly,!windows
+
+package prefixed
+
+// isTerminalFd always reports false on platforms where terminals can't be
+// detected.
+func isTerminalFd(fd uintptr) bool {
+	return false
+}
+
+// terminalWidthFd always reports an unknown width on platforms where it can't
+// be queried.
+func terminalWidthFd(fd uintptr) int {
+	return 0
+}
+
+// enableVirtualTerminal is a no-op outside of Windows, terminals interpret ANSI
+// escape sequences as they are.
+func enableVirtualTerminal() bool {
+	return true
+}
@@ -0,0 +1,81 @@
+//go:build windows
+// +build windows
+
+package prefixed
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const enableVirtualTerminalProcessing = 0x0004
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+var (
+	procGetConsoleMode             = kernel32.NewProc("GetConsoleMode")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+
+	virtualTerminalOnce    sync.Once
+	virtualTerminalEnabled bool
+)
+
+type coord struct {
+	X int16
+	Y int16
+}
+
+type smallRect struct {
+	Left   int16
+	Top    int16
+	Right  int16
+	Bottom int16
+}
+
+type consoleScreenBufferInfo struct {
+	Size              coord
+	CursorPosition    coord
+	Attributes        uint16
+	Window            smallRect
+	MaximumWindowSize coord
+}
+
+// isTerminalFd reports whether fd refers to a console.
+func isTerminalFd(fd uintptr) bool {
+	var mode uint32
+	r, _, _ := syscall.Syscall(procGetConsoleMode.Addr(), 2, fd, uintptr(unsafe.Pointer(&mode)), 0)
+	return r != 0
+}
+
+// terminalWidthFd returns the width of the console fd refers to, or zero when
+// it can't be determined.
+func terminalWidthFd(fd uintptr) int {
+	var info consoleScreenBufferInfo
+	r, _, _ := syscall.Syscall(procGetConsoleScreenBufferInfo.Addr(), 2, fd, uintptr(unsafe.Pointer(&info)), 0)
+	if r == 0 {
+		return 0
+	}
+	return int(info.Window.Right-info.Window.Left) + 1
+}
+
+// enableVirtualTerminal switches the console attached to stderr to virtual
+// terminal mode so that it interprets ANSI escape sequences, which Windows 10
+// and later support. It only tries once and reports whether it succeeded.
+func enableVirtualTerminal() bool {
+	virtualTerminalOnce.Do(func() {
+		var mode uint32
+		r, _, _ := syscall.Syscall(procGetConsoleMode.Addr(), 2, uintptr(syscall.Stderr), uintptr(unsafe.Pointer(&mode)), 0)
+		if r == 0 {
+			return
+		}
+		if mode&enableVirtualTerminalProcessing != 0 {
+			virtualTerminalEnabled = true
+			return
+		}
+		r, _, _ = syscall.Syscall(procSetConsoleMode.Addr(), 2, uintptr(syscall.Stderr), uintptr(mode|enableVirtualTerminalProcessing), 0)
+		virtualTerminalEnabled = r != 0
+	})
+	return virtualTerminalEnabled
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package prefixed
+
+import "testing"
+
+func TestEnableVirtualTerminal(t *testing.T) {
+	// Whether it succeeds depends on the console the tests run in, it only
+	// mustn't panic and has to give the same answer every time.
+	enabled := enableVirtualTerminal()
+	if enableVirtualTerminal() != enabled {
+		t.Error("enableVirtualTerminal() changed its mind")
+	}
+	setColorEnv(t, nil)
+	f := &TextFormatter{EnableWindowsColors: true}
+	if f.IsColored() && !enabled {
+		t.Error("colored without virtual terminal mode")
+	}
+}
@@ -0,0 +1,82 @@
+package prefixed
+
+import (
+	"io"
+	"sync"
+)
+
+// States of the escape sequence parser of colorStrippingWriter.
+const (
+	stripText = iota
+	stripEscape
+	stripCSI
+	stripOSC
+	stripOSCEscape
+)
+
+type colorStrippingWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	state int
+	buf   []byte
+}
+
+// NewColorStrippingWriter returns a writer that removes ANSI escape sequences
+// from everything written through it before passing it on to w, e.g. to mirror
+// the colored output to a file. Sequences split across writes are handled as
+// well.
+func NewColorStrippingWriter(w io.Writer) io.Writer {
+	return &colorStrippingWriter{w: w}
+}
+
+func (s *colorStrippingWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = s.buf[:0]
+	for _, c := range p {
+		switch s.state {
+		case stripText:
+			if c == '\x1b' {
+				s.state = stripEscape
+			} else {
+				s.buf = append(s.buf, c)
+			}
+		case stripEscape:
+			switch c {
+			case '[':
+				s.state = stripCSI
+			case ']':
+				s.state = stripOSC
+			default:
+				// A two-byte sequence, like ESC c.
+				s.state = stripText
+			}
+		case stripCSI:
+			// Parameters and intermediates run up to a final byte in @ to ~.
+			if c >= 0x40 && c <= 0x7e {
+				s.state = stripText
+			}
+		case stripOSC:
+			if c == '\a' {
+				s.state = stripText
+			} else if c == '\x1b' {
+				s.state = stripOSCEscape
+			}
+		case stripOSCEscape:
+			// ESC \ terminates the sequence, anything else continues it.
+			if c == '\\' {
+				s.state = stripText
+			} else if c != '\x1b' {
+				s.state = stripOSC
+			}
+		}
+	}
+
+	if len(s.buf) > 0 {
+		if _, err := s.w.Write(s.buf); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,32 @@
+package prefixed
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestColorStrippingWriter(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"\x1b[0;31mERROR\x1b[0m msg\n"}, "ERROR msg\n"},
+		{[]string{"\x1b", "[0;31mERROR\x1b[0", "m msg\n"}, "ERROR msg\n"},
+		{[]string{"a\x1b[38;2;255;", "136;0mb", "\x1b[0m", "c"}, "abc"},
+		{[]string{"\x1b]8;;file:///a.go\x1b", "\\a.go\x1b]8;;", "\x1b\\ done"}, "a.go done"},
+		{[]string{"bell\x1b]0;title\a", "!"}, "bell!"},
+		{[]string{"x\x1bcy"}, "xy"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		w := NewColorStrippingWriter(&b)
+		for _, chunk := range test.chunks {
+			if n, err := w.Write([]byte(chunk)); err != nil || n != len(chunk) {
+				t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+			}
+		}
+		if b.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.chunks, b.String(), test.want)
+		}
+	}
+}